@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Admin actions on a Plex session.
+const (
+	adminTerminate     = "terminate"
+	adminKillTranscode = "kill_transcode"
+)
+
+const (
+	rulesInterval  = 30 * time.Second
+	noticeDuration = 5 * time.Minute
+)
+
+// Rule stops sessions matching all of its conditions: at least MinBandwidth
+// Mbps, from a remote player when RemoteOnly, transcoding when TranscodeOnly,
+// between From and To ("19:00", "23:00") in the global timezone. Action is
+// terminate or kill_transcode.
+type Rule struct {
+	Name          string  `json:"name"`
+	Action        string  `json:"action"`
+	MinBandwidth  float64 `json:"min_bandwidth_mbps"`
+	RemoteOnly    bool    `json:"remote_only"`
+	TranscodeOnly bool    `json:"transcode_only"`
+	From          string  `json:"from"`
+	To            string  `json:"to"`
+	Reason        string  `json:"reason"`
+}
+
+// adminSession is a session as /admin/sessions lists it.
+type adminSession struct {
+	Server     string  `json:"server"`
+	SessionKey string  `json:"session_key"`
+	User       string  `json:"user"`
+	Player     string  `json:"player"`
+	Title      string  `json:"title"`
+	Remote     bool    `json:"remote"`
+	Transcode  bool    `json:"transcode"`
+	Bandwidth  float64 `json:"bandwidth_mbps"`
+}
+
+func newAdminSession(session trackedSession) adminSession {
+	return adminSession{
+		Server:     session.Server,
+		SessionKey: session.Session.SessionKey,
+		User:       session.Session.User.Title,
+		Player:     session.Session.Player.Title,
+		Title:      strings.TrimSpace(session.Session.GrandparentTitle + " " + session.Session.Title),
+		Remote:     !session.Session.Player.Local || session.Session.Session.Location == "wan",
+		Transcode:  isTranscoding(session),
+		Bandwidth:  float64(session.Session.Session.Bandwidth) / 1000,
+	}
+}
+
+func isTranscoding(session trackedSession) bool {
+	for _, media := range session.Session.Media {
+		for _, part := range media.Part {
+			if part.Decision == "transcode" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func validateRules(rules []Rule) error {
+	for _, rule := range rules {
+		if rule.Action != adminTerminate && rule.Action != adminKillTranscode {
+			return fmt.Errorf("rule %v: unknown action %v", rule.Name, rule.Action)
+		}
+
+		// Without a condition a rule would stop every session.
+		if rule.MinBandwidth <= 0 && !rule.RemoteOnly && !rule.TranscodeOnly && (rule.From == "" || rule.To == "") {
+			return fmt.Errorf("rule %v: no conditions", rule.Name)
+		}
+
+		for _, clock := range []string{rule.From, rule.To} {
+			if _, err := parseClock(clock); clock != "" && err != nil {
+				return fmt.Errorf("rule %v: %v", rule.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseClock reads "19:00" as minutes after midnight.
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %v", clock)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// active reports whether now falls in the rule's window, which may wrap past
+// midnight. A rule without one is always active.
+func (rule Rule) active(now time.Time) bool {
+	if rule.From == "" || rule.To == "" {
+		return true
+	}
+
+	from, _ := parseClock(rule.From)
+	to, _ := parseClock(rule.To)
+	minute := now.Hour()*60 + now.Minute()
+
+	if from <= to {
+		return minute >= from && minute < to
+	}
+
+	return minute >= from || minute < to
+}
+
+func (rule Rule) matches(session adminSession) bool {
+	return session.Bandwidth >= rule.MinBandwidth &&
+		(!rule.RemoteOnly || session.Remote) &&
+		(!rule.TranscodeOnly || session.Transcode)
+}
+
+// runRules applies the rules to every Plex session until stop is closed,
+// stopping each session at most once.
+func runRules(rules []Rule, stop <-chan struct{}) {
+	handled := map[string]bool{}
+
+	ticker := time.NewTicker(rulesInterval)
+	defer ticker.Stop()
+
+	for {
+		applyRules(rules, handled, time.Now().In(Room{}.location()))
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// applyRules is one pass of runRules. A session is only marked handled once
+// a rule has stopped it, so one that failed is tried again next time, and
+// sessions that have ended are forgotten.
+func applyRules(rules []Rule, handled map[string]bool, now time.Time) {
+	seen := map[string]bool{}
+
+	for _, session := range allPlexSessions() {
+		id := session.Server + "/" + session.Session.SessionKey
+		seen[id] = true
+
+		if handled[id] {
+			continue
+		}
+
+		for _, rule := range rules {
+			if !rule.active(now) || !rule.matches(newAdminSession(session)) {
+				continue
+			}
+
+			err := stopSession(session, rule.Action, rule.Reason)
+			if err != nil {
+				log.Printf("rule %v failed to %v session %v: %v", rule.Name, rule.Action, id, err)
+			} else {
+				handled[id] = true
+				log.Printf("rule %v: %v session %v for %v", rule.Name, rule.Action, id, session.Session.User.Title)
+			}
+			break
+		}
+	}
+
+	for id := range handled {
+		if !seen[id] {
+			delete(handled, id)
+		}
+	}
+}
+
+// stopSession terminates a session or kills its transcode, then puts a notice
+// on every clock saying whose stream it was.
+func stopSession(session trackedSession, action, reason string) error {
+	server := findPlexServer(session.Server)
+	if server == nil || server.Client() == nil {
+		return fmt.Errorf("plex server %v is not connected", session.Server)
+	}
+
+	var err error
+	switch action {
+	case adminTerminate:
+		err = server.Client().TerminateSession(session.Session.Session.ID, reason)
+	case adminKillTranscode:
+		var key string
+		key, err = transcodeKey(server, session.Session.SessionKey)
+		if err == nil {
+			_, err = server.Client().KillTranscodeSession(key)
+		}
+	default:
+		err = fmt.Errorf("unknown action %v", action)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	user := session.Session.User.Title
+	if user == "" {
+		user = session.Session.Player.Title
+	}
+
+	postNotice(fmt.Sprintf(catalog(config.Locale).Stopped, user))
+	return nil
+}
+
+// transcodeKey finds the transcode session behind a playback session. The
+// vendored client doesn't read TranscodeSession from /status/sessions, so
+// this does.
+func transcodeKey(server *plexServer, sessionKey string) (string, error) {
+	client := http.Client{Timeout: 5 * time.Second}
+
+	req, err := http.NewRequest("GET", server.Client().URL+"/status/sessions", nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("X-Plex-Token", server.Token())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(resp.Status)
+	}
+
+	var sessions struct {
+		MediaContainer struct {
+			Metadata []struct {
+				SessionKey       string `json:"sessionKey"`
+				TranscodeSession struct {
+					Key string `json:"key"`
+				} `json:"TranscodeSession"`
+			} `json:"Metadata"`
+		} `json:"MediaContainer"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&sessions)
+	if err != nil {
+		return "", err
+	}
+
+	for _, session := range sessions.MediaContainer.Metadata {
+		if session.SessionKey == sessionKey && session.TranscodeSession.Key != "" {
+			return strings.TrimPrefix(session.TranscodeSession.Key, "/transcode/sessions/"), nil
+		}
+	}
+
+	return "", errors.New("session is not transcoding")
+}
+
+// notice is a message shown as an extra frame on every clock for a while.
+var notice struct {
+	sync.Mutex
+	text  string
+	until time.Time
+}
+
+func postNotice(text string) {
+	notice.Lock()
+	defer notice.Unlock()
+
+	notice.text = text
+	notice.until = time.Now().Add(noticeDuration)
+}
+
+func currentNotice(now time.Time) string {
+	notice.Lock()
+	defer notice.Unlock()
+
+	if now.After(notice.until) {
+		return ""
+	}
+
+	return notice.text
+}
+
+func noticeResponse(text string) LametricResponse {
+	return LametricResponse{
+		Frames: []LametricFrame{{Text: text, Icon: defaultIcon}},
+	}
+}
+
+// adminHandler serves the admin API:
+//
+//	GET  /admin/sessions                               every Plex session
+//	POST /admin/sessions/{server}/{session_key}/{action}  terminate or kill_transcode
+//	POST /admin/rules/{rule}                           apply a rule now, whatever the time
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "sessions" && r.Method == http.MethodGet:
+		sessions := []adminSession{}
+		for _, session := range allPlexSessions() {
+			sessions = append(sessions, newAdminSession(session))
+		}
+
+		body, err := json.Marshal(sessions)
+		if err != nil {
+			log.Print(err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	case len(parts) == 4 && parts[0] == "sessions" && r.Method == http.MethodPost:
+		if parts[3] != adminTerminate && parts[3] != adminKillTranscode {
+			writeLametric(w, http.StatusBadRequest, errorResponse(fmt.Sprintf("unknown action %v", parts[3])))
+			return
+		}
+
+		for _, session := range allPlexSessions() {
+			if session.Server != parts[1] || session.Session.SessionKey != parts[2] {
+				continue
+			}
+
+			err := stopSession(session, parts[3], r.URL.Query().Get("reason"))
+			if err != nil {
+				writeLametric(w, http.StatusBadGateway, errorResponse(err.Error()))
+				return
+			}
+
+			writeLametric(w, http.StatusOK, noticeResponse(currentNotice(time.Now())))
+			return
+		}
+
+		writeLametric(w, http.StatusNotFound, errorResponse("session not found"))
+	case len(parts) == 2 && parts[0] == "rules" && r.Method == http.MethodPost:
+		for _, rule := range config.Rules {
+			if rule.Name != parts[1] {
+				continue
+			}
+
+			stopped := 0
+			for _, session := range allPlexSessions() {
+				if !rule.matches(newAdminSession(session)) {
+					continue
+				}
+
+				err := stopSession(session, rule.Action, rule.Reason)
+				if err != nil {
+					log.Printf("rule %v failed to %v session %v: %v", rule.Name, rule.Action, session.Session.SessionKey, err)
+					continue
+				}
+				stopped++
+			}
+
+			writeLametric(w, http.StatusOK, noticeResponse(fmt.Sprintf("%v: %d", rule.Name, stopped)))
+			return
+		}
+
+		writeLametric(w, http.StatusNotFound, errorResponse("rule not found"))
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminSessionActions(t *testing.T) {
+	config = Config{}
+	plexServers = nil
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/admin/sessions/plex/12/reboot", http.StatusBadRequest},
+		{"/admin/sessions/plex/12/", http.StatusNotFound},
+		{"/admin/sessions/plex/12/terminate", http.StatusNotFound},
+		{"/admin/sessions/plex/12/kill_transcode", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		adminHandler(w, httptest.NewRequest("POST", test.path, nil))
+
+		if w.Code != test.want {
+			t.Errorf("POST %v = %d, want %d", test.path, w.Code, test.want)
+		}
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	tests := []struct {
+		rule  Rule
+		valid bool
+	}{
+		{Rule{Name: "busy", Action: adminTerminate, MinBandwidth: 8}, true},
+		{Rule{Name: "remote", Action: adminKillTranscode, RemoteOnly: true}, true},
+		{Rule{Name: "bedtime", Action: adminTerminate, From: "23:00", To: "06:00"}, true},
+		{Rule{Name: "everything", Action: adminTerminate}, false},
+		{Rule{Name: "half window", Action: adminTerminate, From: "23:00"}, false},
+		{Rule{Name: "reboot", Action: "reboot", RemoteOnly: true}, false},
+		{Rule{Name: "late", Action: adminTerminate, From: "25:00", To: "06:00"}, false},
+	}
+
+	for _, test := range tests {
+		err := validateRules([]Rule{test.rule})
+		if (err == nil) != test.valid {
+			t.Errorf("validateRules(%v) = %v", test.rule.Name, err)
+		}
+	}
+}
+
+func TestApplyRulesRetriesFailures(t *testing.T) {
+	config = Config{}
+
+	session := trackedSession{Server: "plex"}
+	session.Session.SessionKey = "12"
+
+	// The server has no client, so stopping the session fails.
+	plexServers = []*plexServer{{name: "plex", sessions: map[string]trackedSession{"12": session}}}
+	defer func() { plexServers = nil }()
+
+	handled := map[string]bool{}
+	applyRules([]Rule{{Name: "remote", Action: adminTerminate, RemoteOnly: true}}, handled, time.Now())
+
+	if handled["plex/12"] {
+		t.Error("a session that couldn't be stopped was marked handled")
+	}
+}
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,26 +11,43 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	plex "github.com/jrudio/go-plex-client"
 	hass "github.com/kylegrantlucas/go-hass"
 )
 
+var config Config
 var haClient *hass.Access
-var nowPlaying NowPlaying
-var plexStatus plex.MetadataV1
+
+// shutdownTimeout bounds how long in-flight requests get to finish.
+const shutdownTimeout = 10 * time.Second
 
 func init() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 }
 
 type NowPlaying struct {
-	Progress   float64
-	ShowTitle  string
-	Title      string
-	Resolution *string
-	Season     int
-	Episode    int
+	Progress   float64  `json:"progress"`
+	ShowTitle  string   `json:"show_title,omitempty"`
+	Title      string   `json:"title,omitempty"`
+	Resolution *string  `json:"resolution,omitempty"`
+	Season     int      `json:"season,omitempty"`
+	Episode    int      `json:"episode,omitempty"`
+	RatingKey  string   `json:"rating_key,omitempty"`
+	Thumb      string   `json:"thumb,omitempty"`
+	Quality    *Quality `json:"quality,omitempty"`
+	Paused     bool     `json:"paused,omitempty"`
+	Live       bool     `json:"live,omitempty"`
+	Channel    string   `json:"channel,omitempty"`
+	Server     string   `json:"server,omitempty"`
+
+	// Position is how far into Duration playback was at UpdatedAt. A zero
+	// UpdatedAt means the position is current as of the lookup.
+	Duration  time.Duration `json:"-"`
+	Position  time.Duration `json:"-"`
+	UpdatedAt time.Time     `json:"-"`
 }
 
 type LametricResponse struct {
@@ -37,25 +55,45 @@ type LametricResponse struct {
 }
 
 type LametricFrame struct {
-	Text  string `json:"text,omitempty"`
-	Icon  string `json:"icon,omitempty"`
-	Index int    `json:"index"`
+	Text     string        `json:"text,omitempty"`
+	Icon     string        `json:"icon,omitempty"`
+	GoalData *LametricGoal `json:"goalData,omitempty"`
+	Index    int           `json:"index"`
+}
+
+// LametricGoal turns a frame into a progress bar from Start to End.
+type LametricGoal struct {
+	Start   int    `json:"start"`
+	Current int    `json:"current"`
+	End     int    `json:"end"`
+	Unit    string `json:"unit,omitempty"`
+}
+
+// DisplayOptions control how a NowPlaying is rendered into frame text.
+// MaxLength and MaxWidth, when set, cap the main frame text in characters and
+// pixels. IdleText replaces the locale's "N/A" when nothing is playing.
+type DisplayOptions struct {
+	QualityBadges []string
+	HideProgress  bool
+	MaxLength     int
+	MaxWidth      int
+	IdleText      string
+	Locale        string
+	Abbreviations map[string]string
+	StripArticles bool
+}
+
+var defaultDisplayOptions = DisplayOptions{
+	QualityBadges: []string{badgeResolution},
 }
 
 func (n NowPlaying) ToString() string {
-	if n.Title == "FuboTV" {
-		return "FuboTV · Live"
-	}
+	return n.Format(defaultDisplayOptions)
+}
 
-	if n.Resolution != nil {
-		res := *n.Resolution
-		if strings.EqualFold(res, "4K") || res == "2160" || strings.EqualFold(res, "2160p") {
-			*n.Resolution = "4k"
-		} else {
-			if !strings.EqualFold(res[len(res)-1:], "p") {
-				*n.Resolution += "p"
-			}
-		}
+func (n NowPlaying) Format(opts DisplayOptions) string {
+	if n.Live && !n.Idle() {
+		return n.formatLive(opts)
 	}
 
 	str := ""
@@ -65,7 +103,7 @@ func (n NowPlaying) ToString() string {
 	}
 
 	if n.Season != 0 && n.Episode != 0 {
-		str += fmt.Sprintf(" S%02d · E%02d:", n.Season, n.Episode)
+		str += " " + fmt.Sprintf(catalog(opts.Locale).Episode, n.Season, n.Episode)
 	}
 
 	if n.Title != "" {
@@ -76,140 +114,403 @@ func (n NowPlaying) ToString() string {
 		}
 	}
 
-	if n.Resolution != nil {
-		str += fmt.Sprintf(" [%d%%] (%s)", int(n.Progress*100), *n.Resolution)
-	} else {
+	if !opts.HideProgress {
 		str += fmt.Sprintf(" [%d%%]", int(n.Progress*100))
 	}
 
-	if n.Title == "" {
-		str = "N/A"
+	if badges := n.quality().Badges(opts.QualityBadges); len(badges) > 0 {
+		str += fmt.Sprintf(" (%s)", strings.Join(badges, " "))
+	}
+
+	if n.Idle() {
+		str = opts.IdleText
+		if str == "" {
+			str = catalog(opts.Locale).Idle
+		}
 	}
 
 	return strings.TrimSpace(str)
 }
 
-func main() {
-	haClient = hass.NewAccess(os.Getenv("HA_HOST"), os.Getenv("HA_TOKEN"))
-	err := haClient.CheckAPI()
-	if err != nil {
-		panic(err)
+// Idle reports whether there is nothing to show.
+func (n NowPlaying) Idle() bool {
+	return n.Title == "" && n.Channel == ""
+}
+
+// formatLive renders live streams as "Channel · Program · Live", since there is
+// no meaningful progress to show.
+func (n NowPlaying) formatLive(opts DisplayOptions) string {
+	var parts []string
+	for _, part := range []string{n.Channel, n.ShowTitle, n.Title} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	str := strings.Join(append(parts, catalog(opts.Locale).Live), " · ")
+
+	if badges := n.quality().Badges(opts.QualityBadges); len(badges) > 0 {
+		str += fmt.Sprintf(" (%s)", strings.Join(badges, " "))
+	}
+
+	return str
+}
+
+// quality falls back to the bare resolution for sources that don't report
+// full stream details.
+func (n NowPlaying) quality() Quality {
+	if n.Quality != nil {
+		return *n.Quality
 	}
 
-	plexConnection, err := plex.New(os.Getenv("PLEX_HOST"), os.Getenv("PLEX_TOKEN"))
+	if n.Resolution != nil {
+		return Quality{Resolution: normalizeResolution(*n.Resolution)}
+	}
+
+	return Quality{}
+}
+
+func main() {
+	var err error
+	config, err = loadConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
+	logLevel, _ = parseLogLevel(config.LogLevel)
 
-	// Test your connection to your Plex server
-	result, err := plexConnection.Test()
+	err = runCommand(os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
+}
 
-	log.Printf("connection status: %v", result)
+// runServe implements `plex-lametric serve`, the default command.
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	port := flags.String("port", config.Port, "port to listen on")
+	record := flags.String("record", "", "append every Plex notification, session list and Home Assistant state read to this JSONL file")
+	flags.Parse(args)
+
+	var err error
+	if *record != "" {
+		traffic, err = newRecorder(*record)
+		if err != nil {
+			return err
+		}
+		defer traffic.close()
+	}
 
-	ctrlC := make(chan os.Signal, 1)
+	// Home Assistant is only needed by rooms with its entities.
+	if config.usesHomeAssistant() {
+		haClient = hass.NewAccess(config.HAHost, config.HAToken)
+		err = haClient.CheckAPI()
+		if err != nil {
+			return err
+		}
 
-	onError := func(err error) {
-		log.Println(err)
+		haStates = haClient
+		if traffic != nil {
+			haStates = recordingStates{haClient}
+		}
+		haStates = timedStates{haStates}
 	}
 
-	events := plex.NewNotificationEvents()
-	events.OnPlaying(func(n plex.NotificationContainer) {
-		sessionID := n.PlaySessionStateNotification[0].SessionKey
+	plexServers, err = configuredPlexServers()
+	if err != nil {
+		return err
+	}
 
-		sessions, err := plexConnection.GetSessions()
+	for _, server := range plexServers {
+		if server.Token() == "" {
+			log.Printf("no plex token configured for %v, run `plex-lametric link` or visit /setup to link your plex account", server.name)
+			continue
+		}
 
+		err = server.connect(server.Token())
 		if err != nil {
-			log.Printf("failed to fetch sessions on plex server: %v\n", err)
-			return
+			return err
 		}
+	}
 
-		for _, session := range sessions.MediaContainer.Metadata {
-			if sessionID != session.SessionKey {
-				continue
-			}
+	sources = startSources(config.Sources)
 
-			viewOffset, _ := strconv.Atoi(session.ViewOffset)
-			duration, _ := strconv.Atoi(session.Duration)
+	stop := make(chan struct{})
+	var background sync.WaitGroup
 
-			plexStatus = session
+	if config.MQTT.Broker != "" {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			runMQTTPublisher(config.MQTT, config.Rooms, stop)
+		}()
+	}
 
-			nowPlaying = NowPlaying{
-				ShowTitle:  session.GrandparentTitle,
-				Title:      session.Title,
-				Progress:   float64(viewOffset) / float64(duration),
-				Resolution: &session.Media[0].VideoResolution,
-				Season:     int(session.ParentIndex),
-				Episode:    int(session.Index),
-			}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		runEvents(config.Rooms, parseInterval(config.EventsInterval, 2*time.Second), stop)
+	}()
 
-			break
+	if len(config.Rules) > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			runRules(config.Rules, stop)
+		}()
+	}
+
+	http.HandleFunc("/", requireAuth("/", handler))
+	http.HandleFunc("/setup", requireLocal("/setup", setupHandler))
+	http.HandleFunc("/healthz", requireAuth("/healthz", healthzHandler))
+	http.HandleFunc("/readyz", requireAuth("/readyz", readyzHandler))
+	http.HandleFunc("/tautulli/", requireAuth("/tautulli", tautulliWebhookHandler))
+	http.HandleFunc("/control/", requireCredentials("/control", controlHandler))
+	http.HandleFunc("/admin/", requireCredentials("/admin", adminHandler))
+	http.HandleFunc("/preview/", requireAuth("/preview", previewHandler))
+	http.HandleFunc("/metrics", requireAuth("/metrics", metricsHandler))
+	http.HandleFunc("/debug/state", requireAuth("/debug", debugStateHandler))
+	http.HandleFunc("/events", requireAuth("/events", eventsHandler))
+	http.HandleFunc("/events/ws", requireAuth("/events", eventsSocketHandler))
+
+	// Event streams outlive WriteTimeout by setting their own deadline on
+	// the connection before each write.
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%v", *port),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		ConnContext:       withConn,
+	}
+	server.RegisterOnShutdown(nowPlayingEvents.close)
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
 		}
-	})
+	}()
 
-	plexConnection.SubscribeToNotifications(events, ctrlC, onError)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	http.HandleFunc("/", handler)
-	port := "8080"
-	if os.Getenv("PORT") != "" {
-		port = os.Getenv("PORT")
-	}
-	err = http.ListenAndServe(fmt.Sprintf(":%v", port), nil)
+	sig := <-signals
+	log.Printf("received %v, shutting down", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(ctx)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("failed to drain http requests: %v", err)
 	}
 
-	endWaiter := sync.WaitGroup{}
-	endWaiter.Add(1)
+	close(stop)
+	background.Wait()
 
-	signal.Notify(ctrlC, os.Interrupt)
+	for _, server := range plexServers {
+		server.close(2 * time.Second)
+	}
 
-	go func() {
-		<-ctrlC
-		endWaiter.Done()
-	}()
+	for _, src := range sources {
+		src.close(2 * time.Second)
+	}
 
-	endWaiter.Wait()
+	return nil
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
-	appleTVStatus, err := haClient.GetState("media_player.living_room_2")
+	room, opts, err := queryOptions(r.URL.Query())
 	if err != nil {
-		panic(err)
+		countRequest(room.Name, http.StatusBadRequest, nil)
+		writeLametric(w, http.StatusBadRequest, errorResponse(err.Error()))
+		return
 	}
 
-	plexHAStatus, err := haClient.GetState("media_player.plex_plex_for_apple_tv_living_room")
+	nowPlaying, err := room.NowPlaying()
 	if err != nil {
-		panic(err)
+		countRequest(room.Name, http.StatusBadGateway, nil)
+		writeLametric(w, http.StatusBadGateway, errorResponse(err.Error()))
+		return
 	}
 
-	nowPlaying = buildNowPlaying(appleTVStatus, plexHAStatus, plexStatus)
+	countRequest(room.Name, http.StatusOK, &nowPlaying)
 
-	w.Header().Add("Content-Type", "application/json")
-	response := LametricResponse{
-		Frames: []LametricFrame{
-			{
-				Text: nowPlaying.ToString(),
-				Icon: "i24240",
-			},
+	writeLametric(w, http.StatusOK, LametricResponse{
+		Frames: room.Frames(nowPlaying, opts),
+	})
+}
+
+// Frames renders the LaMetric frames for a room.
+func (r Room) Frames(nowPlaying NowPlaying, opts DisplayOptions) []LametricFrame {
+	now := clock()
+
+	frames := []LametricFrame{
+		{
+			Text: r.text(nowPlaying, opts, now),
+			Icon: iconFor(nowPlaying),
 		},
 	}
 
-	body, err := json.Marshal(response)
-	if err != nil {
-		log.Print(err)
+	if r.QualityFrame {
+		if badges := nowPlaying.quality().Badges(opts.QualityBadges); len(badges) > 0 {
+			icon := r.QualityIcons[badges[0]]
+			if icon == "" {
+				icon = defaultIcon
+			}
+
+			frames = append(frames, LametricFrame{
+				Text:  strings.Join(badges, " "),
+				Icon:  icon,
+				Index: len(frames),
+			})
+		}
+	}
+
+	if r.TimeFrame && nowPlaying.Duration > 0 {
+		frames = append(frames, LametricFrame{
+			Text:  nowPlaying.timeText(now, r.location(), catalog(opts.Locale)),
+			Icon:  r.timeIcon(),
+			Index: len(frames),
+		})
+	}
+
+	if r.ProgressFrame && nowPlaying.Duration > 0 && !nowPlaying.Idle() {
+		frames = append(frames, LametricFrame{
+			Icon: iconFor(nowPlaying),
+			GoalData: &LametricGoal{
+				Start:   0,
+				Current: int(nowPlaying.Progress * 100),
+				End:     100,
+				Unit:    "%",
+			},
+			Index: len(frames),
+		})
+	}
+
+	if text := currentNotice(now); text != "" {
+		frames = append(frames, LametricFrame{
+			Text:  text,
+			Icon:  defaultIcon,
+			Index: len(frames),
+		})
+	}
+
+	return frames
+}
+
+func (r Room) displayOptions() DisplayOptions {
+	opts := defaultDisplayOptions
+
+	if r.Quality != nil {
+		opts.QualityBadges = r.Quality
+	}
+
+	opts.MaxWidth = r.MaxWidth
+	opts.Abbreviations = r.Abbreviations
+	opts.StripArticles = r.StripArticles
+	opts.Locale = r.locale()
+
+	return opts
+}
+
+// NowPlaying merges the room's Home Assistant entities with the matching
+// session from the Plex servers. It is the single source of what a room
+// displays.
+func (r Room) NowPlaying() (NowPlaying, error) {
+	state, err := r.explain()
+	return state.NowPlaying, err
+}
+
+// playerNowPlaying is what the room's player is playing, from its Plex
+// session.
+func (r Room) playerNowPlaying() NowPlaying {
+	session, ok := r.plexSession()
+	if !ok {
+		return NowPlaying{}
+	}
+
+	return sessionNowPlaying(session)
+}
+
+// sessionNowPlaying maps a tracked session, with its server and state.
+func sessionNowPlaying(session trackedSession) NowPlaying {
+	nowPlaying := nowPlayingFromPlex(session.Session)
+	nowPlaying.Server = session.Server
+	nowPlaying.UpdatedAt = session.UpdatedAt
+	nowPlaying.Paused = session.Session.Player.State == "paused"
+	return nowPlaying
+}
+
+// nowPlayingFromStates merges a room's Home Assistant states with the Plex
+// session that best matches them.
+func nowPlayingFromStates(atv, plexHA hass.State) NowPlaying {
+	session, matched := selectPlexSession(plexHA)
+	nowPlaying, _ := mergeStates(atv, plexHA, session, matched)
+	return nowPlaying
+}
+
+// mergeStates is nowPlayingFromStates with the session already selected,
+// also returning how it decided.
+func mergeStates(atv, plexHA hass.State, session trackedSession, matched bool) (NowPlaying, decision) {
+	nowPlaying, d := buildNowPlaying(atv, plexHA, session.Session)
+	if matched && plexHA.State == "playing" {
+		nowPlaying.Server = session.Server
+	}
+
+	return nowPlaying, d
+}
+
+// nowPlayingFromPlex maps a session from the Plex server itself.
+func nowPlayingFromPlex(session plex.MetadataV1) NowPlaying {
+	viewOffset, _ := strconv.Atoi(session.ViewOffset)
+	duration, _ := strconv.Atoi(session.Duration)
+
+	nowPlaying := NowPlaying{
+		ShowTitle: session.GrandparentTitle,
+		Title:     session.Title,
+		Progress:  progress(float64(viewOffset), float64(duration)),
+		Season:    int(session.ParentIndex),
+		Episode:   int(session.Index),
+		Duration:  time.Duration(duration) * time.Millisecond,
+		Position:  time.Duration(viewOffset) * time.Millisecond,
+		Live:      duration == 0 || strings.HasPrefix(session.Key, "/livetv/"),
+	}
+
+	if len(session.Media) > 0 {
+		resolution := session.Media[0].VideoResolution
+		quality := qualityFromMedia(session.Media[0])
+
+		nowPlaying.Resolution = &resolution
+		nowPlaying.Quality = &quality
 	}
 
-	w.Write(body)
+	nowPlaying.setArtwork(session.RatingKey, session.Thumb, session.GrandparentRatingKey, session.GrandparentThumb)
+
+	return nowPlaying
+}
+
+// setArtwork picks the Plex artwork for the icon. Episode stills make poor
+// icons, so episodes use the show poster.
+func (n *NowPlaying) setArtwork(ratingKey, thumb, showRatingKey, showThumb string) {
+	n.RatingKey = ratingKey
+	n.Thumb = thumb
+
+	if showThumb != "" {
+		n.RatingKey = showRatingKey
+		n.Thumb = showThumb
+	}
 }
 
-func buildNowPlaying(atv, plexHA hass.State, plexDirect plex.MetadataV1) NowPlaying {
+// buildNowPlaying prefers the Plex session when the Plex entity is playing
+// it, then the Plex entity's own attributes, then whatever the Apple TV
+// reports.
+func buildNowPlaying(atv, plexHA hass.State, plexDirect plex.MetadataV1) (NowPlaying, decision) {
 	var nowPlaying NowPlaying
+	var d decision
 
 	if atv.State != "playing" && atv.State != "paused" {
-		return nowPlaying
+		return nowPlaying, decision{branchIdle, fmt.Sprintf("apple tv is '%v'", atv.State)}
 	}
 
 	if plexHA.State == "playing" {
@@ -223,20 +524,18 @@ func buildNowPlaying(atv, plexHA hass.State, plexDirect plex.MetadataV1) NowPlay
 			mediaTitle = *plexHA.Attributes.MediaTitle
 		}
 
-		if mediaSeriesTitle == plexDirect.GrandparentTitle && mediaTitle == plexDirect.Title {
-			viewOffset, _ := strconv.Atoi(plexDirect.ViewOffset)
-			duration, _ := strconv.Atoi(plexDirect.Duration)
-			resolution := plexDirect.Media[0].VideoResolution
+		haTitle := joinTitles(mediaSeriesTitle, mediaTitle)
+		plexTitle := joinTitles(plexDirect.GrandparentTitle, plexDirect.Title)
 
-			nowPlaying = NowPlaying{
-				ShowTitle:  plexDirect.GrandparentTitle,
-				Title:      plexDirect.Title,
-				Progress:   float64(viewOffset) / float64(duration),
-				Resolution: &resolution,
-				Season:     int(plexDirect.ParentIndex),
-				Episode:    int(plexDirect.Index),
-			}
+		if mediaSeriesTitle == plexDirect.GrandparentTitle && mediaTitle == plexDirect.Title {
+			nowPlaying = nowPlayingFromPlex(plexDirect)
+			d = decision{branchPlexSession, fmt.Sprintf("plex HA title matches session %v: '%v'", plexDirect.SessionKey, plexTitle)}
 		} else {
+			d = decision{branchPlexHA, fmt.Sprintf("plex HA title mismatch: '%v' vs '%v'", haTitle, plexTitle)}
+			if plexDirect.SessionKey == "" {
+				d.Reason = fmt.Sprintf("no plex session for plex HA title '%v'", haTitle)
+			}
+
 			var episodeNumber int
 			var mediaSeason int
 
@@ -247,48 +546,102 @@ func buildNowPlaying(atv, plexHA hass.State, plexDirect plex.MetadataV1) NowPlay
 				episodeNumber = *plexHA.Attributes.MediaEpisode
 			}
 
+			var mediaPosition int
+			var mediaDuration int
+
+			if plexHA.Attributes.MediaPosition != nil {
+				mediaPosition = *plexHA.Attributes.MediaPosition
+			}
+			if plexHA.Attributes.MediaDuration != nil {
+				mediaDuration = *plexHA.Attributes.MediaDuration
+			}
+
 			nowPlaying = NowPlaying{
 				ShowTitle: mediaSeriesTitle,
 				Title:     mediaTitle,
-				Progress:  float64(*plexHA.Attributes.MediaPosition) / float64(*plexHA.Attributes.MediaDuration),
+				Progress:  progress(float64(mediaPosition), float64(mediaDuration)),
 				Season:    mediaSeason,
 				Episode:   episodeNumber,
+				Duration:  time.Duration(mediaDuration) * time.Second,
+				Position:  time.Duration(mediaPosition) * time.Second,
+				Live:      mediaDuration == 0 || isLiveContentType(plexHA.Attributes.MediaContentType),
+			}
+
+			if plexHA.Attributes.MediaPositionUpdatedAt != nil {
+				nowPlaying.UpdatedAt = *plexHA.Attributes.MediaPositionUpdatedAt
 			}
 		}
 	} else {
-		if atv.Attributes.MediaAlbumName != nil && *atv.Attributes.MediaAlbumName == "FuboTV" {
-			nowPlaying = NowPlaying{
-				Title: *atv.Attributes.MediaAlbumName,
-			}
-		} else {
-			mediaArtist := ""
-			mediaTitle := ""
+		mediaArtist := ""
+		mediaTitle := ""
+		channel := ""
 
-			if atv.Attributes.MediaArtist != nil {
-				mediaArtist = *atv.Attributes.MediaArtist
-			}
+		if atv.Attributes.MediaArtist != nil {
+			mediaArtist = *atv.Attributes.MediaArtist
+		}
 
-			if atv.Attributes.MediaTitle != nil {
-				mediaTitle = *atv.Attributes.MediaTitle
-			}
+		if atv.Attributes.MediaTitle != nil {
+			mediaTitle = *atv.Attributes.MediaTitle
+		}
 
-			mediaPosition := 0.0
-			mediaDuration := 0.0
+		if atv.Attributes.MediaAlbumName != nil {
+			channel = *atv.Attributes.MediaAlbumName
+		} else if atv.Attributes.AppName != nil {
+			channel = *atv.Attributes.AppName
+		}
 
-			if atv.Attributes.MediaPosition != nil {
-				mediaPosition = float64(*atv.Attributes.MediaPosition)
-			}
+		mediaPosition := 0.0
+		mediaDuration := 0.0
 
-			if atv.Attributes.MediaDuration != nil {
-				mediaDuration = float64(*atv.Attributes.MediaDuration)
-			}
+		if atv.Attributes.MediaPosition != nil {
+			mediaPosition = float64(*atv.Attributes.MediaPosition)
+		}
+
+		if atv.Attributes.MediaDuration != nil {
+			mediaDuration = float64(*atv.Attributes.MediaDuration)
+		}
+
+		d = decision{branchAppleTV, fmt.Sprintf("plex HA is '%v'", plexHA.State)}
 
+		// FuboTV only reports itself as the album, with no title or duration.
+		if channel == "FuboTV" || mediaDuration == 0 || isLiveContentType(atv.Attributes.MediaContentType) {
+			d = decision{branchAppleTVLive, fmt.Sprintf("plex HA is '%v' and apple tv channel '%v' is live", plexHA.State, channel)}
+			nowPlaying = NowPlaying{
+				Title:   strings.TrimSpace(mediaArtist + " " + mediaTitle),
+				Channel: channel,
+				Live:    true,
+			}
+		} else {
 			nowPlaying = NowPlaying{
 				Title:    mediaArtist + " " + mediaTitle,
-				Progress: float64(mediaPosition) / float64(mediaDuration),
+				Progress: progress(mediaPosition, mediaDuration),
+				Duration: time.Duration(mediaDuration) * time.Second,
+				Position: time.Duration(mediaPosition) * time.Second,
+			}
+
+			if atv.Attributes.MediaPositionUpdatedAt != nil {
+				nowPlaying.UpdatedAt = *atv.Attributes.MediaPositionUpdatedAt
 			}
 		}
 	}
 
-	return nowPlaying
+	nowPlaying.Paused = atv.State == "paused"
+
+	return nowPlaying, d
+}
+
+// progress is position as a fraction of duration, or zero for streams without
+// a duration.
+func progress(position, duration float64) float64 {
+	if duration <= 0 {
+		return 0
+	}
+
+	return position / duration
+}
+
+// isLiveContentType reports whether a Home Assistant media_content_type is a
+// live channel.
+func isLiveContentType(contentType *string) bool {
+	return contentType != nil && (*contentType == "channel" || *contentType == "tvchannel")
 }
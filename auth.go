@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Credential is one accepted login: either a Basic auth username and
+// password, or a bearer token.
+type Credential struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+// allRoutes is the auth config key whose credentials apply to every route
+// without its own list.
+const allRoutes = "*"
+
+// requireAuth wraps a route so that it only answers requests carrying one of
+// the credentials configured for it. Routes without credentials stay open.
+func requireAuth(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		credentials, ok := config.Auth[route]
+		if !ok {
+			credentials = config.Auth[allRoutes]
+		}
+
+		if len(credentials) == 0 || authorized(r, credentials) {
+			h(w, r)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="plex-lametric"`)
+		writeLametric(w, http.StatusUnauthorized, errorResponse(catalog(config.Locale).Unauthorized))
+	}
+}
+
+// requireCredentials is requireAuth for routes that change things, which
+// stay closed until credentials are configured for them.
+func requireCredentials(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		credentials, ok := config.Auth[route]
+		if !ok {
+			credentials = config.Auth[allRoutes]
+		}
+
+		if len(credentials) == 0 {
+			writeLametric(w, http.StatusForbidden, errorResponse(catalog(config.Locale).Unauthorized))
+			return
+		}
+
+		requireAuth(route, h)(w, r)
+	}
+}
+
+// requireLocal is requireAuth for routes that hand out control of the server
+// itself. Until credentials are configured for them they only answer requests
+// from loopback and private addresses.
+func requireLocal(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		credentials, ok := config.Auth[route]
+		if !ok {
+			credentials = config.Auth[allRoutes]
+		}
+
+		if len(credentials) == 0 && !localAddress(r.RemoteAddr) {
+			writeLametric(w, http.StatusForbidden, errorResponse(catalog(config.Locale).Unauthorized))
+			return
+		}
+
+		requireAuth(route, h)(w, r)
+	}
+}
+
+var localNetworks = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+}
+
+// localAddress reports whether a request's remote address is loopback or on
+// a private network.
+func localAddress(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, cidr := range localNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func authorized(r *http.Request, credentials []Credential) bool {
+	username, password, hasBasic := r.BasicAuth()
+
+	var token string
+	if header := r.Header.Get("Authorization"); len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		token = strings.TrimSpace(header[7:])
+	}
+
+	for _, credential := range credentials {
+		if credential.Token != "" && token != "" && secureCompare(credential.Token, token) {
+			return true
+		}
+
+		if credential.Username != "" && hasBasic {
+			// Compare both halves every time so timing doesn't reveal which
+			// one was wrong.
+			usernameOK := secureCompare(credential.Username, username)
+			passwordOK := secureCompare(credential.Password, password)
+			if usernameOK && passwordOK {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func secureCompare(expected, actual string) bool {
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
+}
+
+// errorResponse is a single frame LaMetric can still display, so a
+// misconfigured clock shows what went wrong rather than nothing.
+func errorResponse(text string) LametricResponse {
+	return LametricResponse{
+		Frames: []LametricFrame{
+			{
+				Text: text,
+				Icon: defaultIcon,
+			},
+		},
+	}
+}
+
+func writeLametric(w http.ResponseWriter, status int, response LametricResponse) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		log.Print(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	plex "github.com/jrudio/go-plex-client"
+	hass "github.com/kylegrantlucas/go-hass"
+)
+
+// command is a plex-lametric subcommand.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+func commands() []command {
+	return []command{
+		{"serve", "serve the LaMetric app (the default)", runServe},
+		{"link", "link a Plex account with a PIN", runLink},
+		{"check", "check the config and connections, and list the rooms' entities", runCheck},
+		{"sessions", "print every Plex session as plex-lametric sees it", runSessions},
+		{"render", "render a room's frames, or preview them, from saved Plex and Home Assistant JSON", runRender},
+		{"replay", "serve the app from a recording made with serve -record", runReplay},
+	}
+}
+
+// runCommand runs the subcommand named by the first argument, or serve when
+// there isn't one.
+func runCommand(args []string) error {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return cmd.run(args)
+		}
+	}
+
+	usage()
+	os.Exit(2)
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: plex-lametric <command> [flags]\n\nCommands:\n")
+	for _, cmd := range commands() {
+		fmt.Fprintf(os.Stderr, "  %-10v %v\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun plex-lametric <command> -h for a command's flags.\n")
+}
+
+// runCheck implements `plex-lametric check`. The config was already
+// validated by loading it, so this tries every connection and reports what
+// each room's entities are doing.
+func runCheck(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.Parse(args)
+
+	failed := 0
+	report := func(name string, err error) {
+		if err != nil {
+			failed++
+			fmt.Printf("%-24v FAIL %v\n", name, err)
+			return
+		}
+		fmt.Printf("%-24v ok\n", name)
+	}
+
+	report("config", nil)
+
+	servers, err := configuredPlexServers()
+	if err != nil {
+		return err
+	}
+
+	for _, server := range servers {
+		_, err := server.dial()
+		report("plex "+server.name, err)
+	}
+
+	err = nil
+	if config.usesHomeAssistant() {
+		haClient = hass.NewAccess(config.HAHost, config.HAToken)
+		err = haClient.CheckAPI()
+		report("home assistant", err)
+	}
+
+	if err == nil {
+		for _, room := range config.Rooms {
+			fmt.Printf("\nroom %v\n", room.Name)
+
+			if room.Source != "" {
+				fmt.Printf("  source %v\n", room.Source)
+				continue
+			}
+
+			if room.AppleTVEntity == "" && room.PlexEntity == "" {
+				fmt.Printf("  plex player %q\n", room.Player)
+				continue
+			}
+
+			for _, entity := range []string{room.AppleTVEntity, room.PlexEntity} {
+				if entity == "" {
+					continue
+				}
+
+				state, err := haClient.GetState(entity)
+				if err != nil {
+					failed++
+					fmt.Printf("  %-22v FAIL %v\n", entity, err)
+					continue
+				}
+
+				fmt.Printf("  %-22v %v\n", entity, describeState(state))
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+
+	return nil
+}
+
+// describeState summarises a media player state as "playing (Show · Title)".
+func describeState(state hass.State) string {
+	var titles []string
+	for _, title := range []*string{state.Attributes.MediaSeriesTitle, state.Attributes.MediaArtist, state.Attributes.MediaTitle} {
+		if title != nil && *title != "" {
+			titles = append(titles, *title)
+		}
+	}
+
+	if len(titles) == 0 {
+		return state.State
+	}
+
+	return fmt.Sprintf("%v (%v)", state.State, strings.Join(titles, " · "))
+}
+
+// sessionDump is a session as `plex-lametric sessions` prints it.
+type sessionDump struct {
+	Server     string     `json:"server"`
+	SessionKey string     `json:"session_key"`
+	Player     string     `json:"player"`
+	User       string     `json:"user"`
+	NowPlaying NowPlaying `json:"now_playing"`
+}
+
+// runSessions implements `plex-lametric sessions`. With -raw it prints the
+// servers' sessions merged into one /status/sessions response, which render
+// reads back.
+func runSessions(args []string) error {
+	flags := flag.NewFlagSet("sessions", flag.ExitOnError)
+	raw := flags.Bool("raw", false, "print the sessions as Plex returns them")
+	flags.Parse(args)
+
+	servers, err := configuredPlexServers()
+	if err != nil {
+		return err
+	}
+
+	var merged plex.CurrentSessions
+	dump := []sessionDump{}
+
+	for _, server := range servers {
+		client, err := server.dial()
+		if err != nil {
+			return fmt.Errorf("plex server %v: %v", server.name, err)
+		}
+
+		sessions, err := client.GetSessions()
+		if err != nil {
+			return fmt.Errorf("plex server %v: %v", server.name, err)
+		}
+
+		merged.MediaContainer.Metadata = append(merged.MediaContainer.Metadata, sessions.MediaContainer.Metadata...)
+
+		for _, session := range sessions.MediaContainer.Metadata {
+			nowPlaying := nowPlayingFromPlex(session)
+			nowPlaying.Server = server.name
+			nowPlaying.Paused = session.Player.State == "paused"
+
+			dump = append(dump, sessionDump{
+				Server:     server.name,
+				SessionKey: session.SessionKey,
+				Player:     session.Player.Title,
+				User:       session.User.Title,
+				NowPlaying: nowPlaying,
+			})
+		}
+	}
+
+	merged.MediaContainer.Size = len(merged.MediaContainer.Metadata)
+
+	if *raw {
+		return printJSON(merged)
+	}
+
+	return printJSON(dump)
+}
+
+// runRender implements `plex-lametric render`, which prints the frames a
+// room would show given a saved /status/sessions response (from `sessions
+// -raw`) and Home Assistant states (from /api/states), without connecting to
+// either.
+func runRender(args []string) error {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	roomName := flags.String("room", "", "room to render, the first one by default")
+	plexJSON := flags.String("plex-json", "", "file with a Plex /status/sessions response")
+	haJSON := flags.String("ha-json", "", "file with a list of Home Assistant states")
+	format := flags.String("format", "json", "json, png, gif or term")
+	out := flags.String("o", "", "file to write to instead of stdout")
+	flags.Parse(args)
+
+	write, ok := renderFormats[*format]
+	if !ok {
+		return fmt.Errorf("unknown format %v", *format)
+	}
+
+	room, ok := config.findRoom(*roomName)
+	if !ok {
+		return fmt.Errorf("unknown room %v", *roomName)
+	}
+
+	if room.Source != "" {
+		return fmt.Errorf("room %v reads from source %v, which render can't replay", room.Name, room.Source)
+	}
+
+	server := &plexServer{name: "saved", sessions: map[string]trackedSession{}}
+	plexServers = []*plexServer{server}
+
+	if *plexJSON != "" {
+		var sessions plex.CurrentSessions
+		err := readJSON(*plexJSON, &sessions)
+		if err != nil {
+			return err
+		}
+
+		server.updateSessions(sessions.MediaContainer.Metadata, "", time.Now())
+	}
+
+	var nowPlaying NowPlaying
+
+	if room.AppleTVEntity == "" && room.PlexEntity == "" {
+		nowPlaying = room.playerNowPlaying()
+	} else {
+		if *haJSON == "" {
+			return errors.New("room has home assistant entities, so render needs -ha-json")
+		}
+
+		var states []hass.State
+		err := readJSON(*haJSON, &states)
+		if err != nil {
+			return err
+		}
+
+		var atv, plexHA hass.State
+		for _, state := range states {
+			switch state.EntityID {
+			case room.AppleTVEntity:
+				atv = state
+			case room.PlexEntity:
+				plexHA = state
+			}
+		}
+
+		nowPlaying = nowPlayingFromStates(atv, plexHA)
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	return write(w, room.Frames(nowPlaying, room.displayOptions()))
+}
+
+// renderFormats are the ways render can show frames: as the app's JSON, or
+// through the display simulator.
+var renderFormats = map[string]func(io.Writer, []LametricFrame) error{
+	"json": writeFramesJSON,
+	"png":  writePNG,
+	"gif":  writeGIF,
+	"term": writeTerminal,
+}
+
+func writeFramesJSON(w io.Writer, frames []LametricFrame) error {
+	body, err := json.MarshalIndent(LametricResponse{Frames: frames}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(w, string(body))
+	return err
+}
+
+func readJSON(path string, v interface{}) error {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+
+	return nil
+}
+
+func printJSON(v interface{}) error {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(body))
+	return nil
+}
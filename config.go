@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config is loaded from the optional JSON file named by CONFIG_FILE. The
+// original environment variables still work and take precedence over the file.
+type Config struct {
+	Port        string             `json:"port"`
+	HAHost      string             `json:"ha_host"`
+	HAToken     string             `json:"ha_token"`
+	PlexHost    string             `json:"plex_host"`
+	PlexToken   string             `json:"plex_token"`
+	PlexServer  string             `json:"plex_server"`
+	PlexServers []PlexServerConfig `json:"plex_servers"`
+	Rooms       []Room             `json:"rooms"`
+	MQTT        MQTTConfig         `json:"mqtt"`
+	Timezone    string             `json:"timezone"`
+	StateFile   string             `json:"state_file"`
+	PlexTVURL   string             `json:"plex_tv_url"`
+	Locale      string             `json:"locale"`
+	Sources     []SourceConfig     `json:"sources"`
+	Rules       []Rule             `json:"rules"`
+	LogLevel    string             `json:"log_level"`
+
+	// EventsInterval is how often rooms are polled for /events, 2s by
+	// default.
+	EventsInterval string `json:"events_interval"`
+
+	// EventsOrigins lists the browser origins, like "http://tablet.lan:8123",
+	// that may open /events and /events/ws from another site. "*" allows
+	// any.
+	EventsOrigins []string `json:"events_origins"`
+
+	// Auth maps a route ("/", "/setup") to the credentials it accepts. The
+	// "*" entry applies to routes without their own.
+	Auth map[string][]Credential `json:"auth"`
+}
+
+// Room is a single display location, made up of the Apple TV and Plex
+// media_player entities Home Assistant exposes for it.
+//
+// Quality lists the badges appended to the now-playing text (resolution,
+// video_codec, dynamic_range, audio, decision); it defaults to just the
+// resolution. QualityFrame adds a second frame with the same badges, using
+// the icon QualityIcons maps the first badge to.
+//
+// Template, when set, is a text/template that replaces the default frame
+// text. TimeFrame adds a "42m left · ends 21:47" frame, shown in Timezone
+// (falling back to the global timezone, then the local one). ProgressFrame
+// adds a goal frame, a bar that fills as playback progresses.
+//
+// Text is always sanitized for the clock's font. Abbreviations replaces whole
+// words ("Season": "S"), StripArticles drops a leading "The " from titles, and
+// MaxWidth cuts the main frame down to that many pixels at a word boundary.
+// Locale picks the language (en, de, es), falling back to the global one.
+//
+// Source, when set, names a configured source to read what's playing from
+// instead of Home Assistant, showing the session on Player (a device, client
+// or user name) or the most recently active one. A room with neither a source
+// nor Home Assistant entities follows Player's Plex session the same way.
+type Room struct {
+	Name          string            `json:"name"`
+	AppleTVEntity string            `json:"apple_tv_entity"`
+	PlexEntity    string            `json:"plex_entity"`
+	Quality       []string          `json:"quality"`
+	QualityFrame  bool              `json:"quality_frame"`
+	QualityIcons  map[string]string `json:"quality_icons"`
+	Template      string            `json:"template"`
+	TimeFrame     bool              `json:"time_frame"`
+	TimeIcon      string            `json:"time_icon"`
+	ProgressFrame bool              `json:"progress_frame"`
+	Timezone      string            `json:"timezone"`
+	Abbreviations map[string]string `json:"abbreviations"`
+	StripArticles bool              `json:"strip_articles"`
+	MaxWidth      int               `json:"max_width"`
+	Locale        string            `json:"locale"`
+	Source        string            `json:"source"`
+	Player        string            `json:"player"`
+}
+
+// PlexServerConfig is one Plex server to watch. Host is discovered when empty,
+// using Server (a name or machine ID) to pick among the account's servers.
+type PlexServerConfig struct {
+	Name   string `json:"name"`
+	Host   string `json:"host"`
+	Token  string `json:"token"`
+	Server string `json:"server"`
+}
+
+type MQTTConfig struct {
+	Broker          string `json:"broker"`
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	ClientID        string `json:"client_id"`
+	TopicPrefix     string `json:"topic_prefix"`
+	DiscoveryPrefix string `json:"discovery_prefix"`
+	Interval        string `json:"interval"`
+}
+
+var defaultRoom = Room{
+	Name:          "living_room",
+	AppleTVEntity: "media_player.living_room_2",
+	PlexEntity:    "media_player.plex_plex_for_apple_tv_living_room",
+}
+
+func loadConfig() (Config, error) {
+	var config Config
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return config, err
+		}
+
+		err = json.Unmarshal(body, &config)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	envOverride(&config.Port, "PORT")
+	envOverride(&config.HAHost, "HA_HOST")
+	envOverride(&config.HAToken, "HA_TOKEN")
+	envOverride(&config.PlexHost, "PLEX_HOST")
+	envOverride(&config.PlexToken, "PLEX_TOKEN")
+	envOverride(&config.PlexServer, "PLEX_SERVER")
+	envOverride(&config.MQTT.Broker, "MQTT_BROKER")
+	envOverride(&config.MQTT.Username, "MQTT_USERNAME")
+	envOverride(&config.MQTT.Password, "MQTT_PASSWORD")
+	envOverride(&config.MQTT.ClientID, "MQTT_CLIENT_ID")
+	envOverride(&config.MQTT.TopicPrefix, "MQTT_TOPIC_PREFIX")
+	envOverride(&config.MQTT.DiscoveryPrefix, "MQTT_DISCOVERY_PREFIX")
+	envOverride(&config.MQTT.Interval, "MQTT_INTERVAL")
+
+	if config.Port == "" {
+		config.Port = "8080"
+	}
+
+	// A single server can still be set up with the original variables.
+	if len(config.PlexServers) == 0 && (config.PlexHost != "" || config.PlexToken != "" || config.PlexServer != "") {
+		config.PlexServers = []PlexServerConfig{{
+			Host:   config.PlexHost,
+			Token:  config.PlexToken,
+			Server: config.PlexServer,
+		}}
+	}
+
+	envOverride(&config.Timezone, "TIMEZONE")
+	envOverride(&config.StateFile, "STATE_FILE")
+	envOverride(&config.PlexTVURL, "PLEX_TV_URL")
+	envOverride(&config.Locale, "LOCALE")
+	envOverride(&config.LogLevel, "LOG_LEVEL")
+	envOverride(&config.EventsInterval, "EVENTS_INTERVAL")
+
+	if origins := os.Getenv("EVENTS_ORIGINS"); origins != "" {
+		config.EventsOrigins = nil
+		for _, origin := range strings.Split(origins, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				config.EventsOrigins = append(config.EventsOrigins, origin)
+			}
+		}
+	}
+
+	// Credentials from the environment protect every route.
+	if os.Getenv("AUTH_USERNAME") != "" || os.Getenv("AUTH_TOKEN") != "" {
+		if config.Auth == nil {
+			config.Auth = map[string][]Credential{}
+		}
+
+		if username := os.Getenv("AUTH_USERNAME"); username != "" {
+			config.Auth[allRoutes] = append(config.Auth[allRoutes], Credential{
+				Username: username,
+				Password: os.Getenv("AUTH_PASSWORD"),
+			})
+		}
+
+		if token := os.Getenv("AUTH_TOKEN"); token != "" {
+			config.Auth[allRoutes] = append(config.Auth[allRoutes], Credential{Token: token})
+		}
+	}
+
+	if config.StateFile == "" {
+		config.StateFile = "plex-lametric.json"
+	}
+
+	if len(config.Rooms) == 0 {
+		config.Rooms = []Room{defaultRoom}
+	}
+
+	for _, timezone := range append(roomTimezones(config.Rooms), config.Timezone) {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			return config, err
+		}
+	}
+
+	if err := validateSources(config.Sources, config.Rooms); err != nil {
+		return config, err
+	}
+
+	if err := validateLocale(config.Locale); err != nil {
+		return config, err
+	}
+
+	if err := validateRules(config.Rules); err != nil {
+		return config, err
+	}
+
+	if _, err := parseLogLevel(config.LogLevel); err != nil {
+		return config, err
+	}
+
+	for _, room := range config.Rooms {
+		if _, err := parseTemplate(room.Template); err != nil {
+			return config, fmt.Errorf("room %v: %v", room.Name, err)
+		}
+
+		if err := validateLocale(room.Locale); err != nil {
+			return config, fmt.Errorf("room %v: %v", room.Name, err)
+		}
+
+		if err := validateQuality(room.Quality, room.QualityIcons); err != nil {
+			return config, fmt.Errorf("room %v: %v", room.Name, err)
+		}
+	}
+
+	return config, nil
+}
+
+// usesHomeAssistant reports whether any room reads Home Assistant entities.
+func (c Config) usesHomeAssistant() bool {
+	for _, room := range c.Rooms {
+		if room.AppleTVEntity != "" || room.PlexEntity != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// usesPlex reports whether any room reads from Plex rather than a source.
+func (c Config) usesPlex() bool {
+	for _, room := range c.Rooms {
+		if room.Source == "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func roomTimezones(rooms []Room) []string {
+	var timezones []string
+	for _, room := range rooms {
+		timezones = append(timezones, room.Timezone)
+	}
+
+	return timezones
+}
+
+func envOverride(field *string, key string) {
+	if value := os.Getenv(key); value != "" {
+		*field = value
+	}
+}
+
+// findRoom looks up a room by name, falling back to the first configured room
+// when name is empty.
+func (c Config) findRoom(name string) (Room, bool) {
+	if name == "" {
+		return c.Rooms[0], true
+	}
+
+	for _, room := range c.Rooms {
+		if strings.EqualFold(room.Name, name) {
+			return room, true
+		}
+	}
+
+	return Room{}, false
+}
+
+func parseInterval(value string, fallback time.Duration) time.Duration {
+	if value == "" {
+		return fallback
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return fallback
+	}
+
+	return interval
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Actions a clock's buttons can send to /control/{room}/{action}.
+const (
+	actionPlayPause = "play_pause"
+	actionSkip      = "skip"
+	actionStop      = "stop"
+)
+
+var haServices = map[string]string{
+	actionPlayPause: "media_play_pause",
+	actionSkip:      "media_next_track",
+	actionStop:      "media_stop",
+}
+
+// controller is a source that can also control playback.
+type controller interface {
+	Control(player, action string) error
+}
+
+var plexCommandID int64
+
+// controlHandler serves /control/{room}/{action}, returning the room's frames
+// as they are after the action.
+func controlHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/control/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	room, ok := config.findRoom(parts[0])
+	if !ok || parts[0] == "" {
+		writeLametric(w, http.StatusNotFound, errorResponse(fmt.Sprintf("unknown room %v", parts[0])))
+		return
+	}
+
+	action := parts[1]
+	if _, ok := haServices[action]; !ok {
+		writeLametric(w, http.StatusBadRequest, errorResponse(fmt.Sprintf("unknown action %v", action)))
+		return
+	}
+
+	err := room.control(action)
+	if err != nil {
+		writeLametric(w, http.StatusBadGateway, errorResponse(err.Error()))
+		return
+	}
+
+	nowPlaying, err := room.NowPlaying()
+	if err != nil {
+		writeLametric(w, http.StatusBadGateway, errorResponse(err.Error()))
+		return
+	}
+
+	writeLametric(w, http.StatusOK, LametricResponse{
+		Frames: room.Frames(nowPlaying, room.displayOptions()),
+	})
+}
+
+// control sends action to whatever the room is playing on: its source, its
+// Home Assistant media player, or else its player's Plex session.
+func (r Room) control(action string) error {
+	if r.Source != "" {
+		src, ok := sources[r.Source].(controller)
+		if !ok {
+			return fmt.Errorf("source %v can't control playback", r.Source)
+		}
+
+		return src.Control(r.Player, action)
+	}
+
+	entity := r.AppleTVEntity
+	if entity == "" {
+		entity = r.PlexEntity
+	}
+
+	if entity != "" {
+		start := time.Now()
+		err := haClient.CallService("media_player", haServices[action], entity)
+		observeCall("home_assistant", "call_service", start, err)
+		return err
+	}
+
+	session, ok := r.plexSession()
+	if !ok {
+		return errors.New("nothing is playing")
+	}
+
+	server := findPlexServer(session.Server)
+	if server == nil || server.Client() == nil {
+		return fmt.Errorf("plex server %v is not connected", session.Server)
+	}
+
+	command := map[string]string{
+		actionPlayPause: "pause",
+		actionSkip:      "skipNext",
+		actionStop:      "stop",
+	}[action]
+
+	if action == actionPlayPause && session.Session.Player.State == "paused" {
+		command = "play"
+	}
+
+	return plexPlayerCommand(server, session.Session.Player.MachineIdentifier, command)
+}
+
+// plexPlayerCommand has the server relay a playback command to one of its
+// players. The vendored client only has StopPlayback, so this mirrors it for
+// the others.
+func plexPlayerCommand(server *plexServer, machineID, command string) error {
+	client := http.Client{Timeout: 5 * time.Second}
+
+	url := fmt.Sprintf("%v/player/playback/%v?type=video&commandID=%d", server.Client().URL, command, atomic.AddInt64(&plexCommandID, 1))
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("X-Plex-Token", server.Token())
+	req.Header.Add("X-Plex-Target-Client-Identifier", machineID)
+	req.Header.Add("X-Plex-Client-Identifier", "plex-lametric")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	plex "github.com/jrudio/go-plex-client"
+	hass "github.com/kylegrantlucas/go-hass"
+)
+
+// Branches a room's NowPlaying can come from.
+const (
+	branchSource      = "source"
+	branchPlayer      = "player"
+	branchIdle        = "idle"
+	branchPlexSession = "plex_session"
+	branchPlexHA      = "plex_ha"
+	branchAppleTV     = "apple_tv"
+	branchAppleTVLive = "apple_tv_live"
+	branchError       = "error"
+)
+
+// decision is which branch produced a room's NowPlaying, and why.
+type decision struct {
+	Branch string `json:"branch"`
+	Reason string `json:"reason"`
+}
+
+// roomExplanation is everything that went into a room's NowPlaying: the raw
+// Home Assistant states, the Plex session picked to go with them, and the
+// decision made from them.
+type roomExplanation struct {
+	Room       string      `json:"room"`
+	Source     string      `json:"source,omitempty"`
+	AppleTV    *hass.State `json:"apple_tv,omitempty"`
+	PlexHA     *hass.State `json:"plex_ha,omitempty"`
+	PlexStatus plexStatus  `json:"plex_status"`
+	Decision   decision    `json:"decision"`
+	NowPlaying NowPlaying  `json:"now_playing"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// plexStatus is what the Plex servers are reporting, and the session a room
+// picked from them.
+type plexStatus struct {
+	Servers  []plexServerStatus `json:"servers,omitempty"`
+	Selected *debugSession      `json:"selected,omitempty"`
+	Matched  bool               `json:"matched"`
+}
+
+type plexServerStatus struct {
+	Name       string         `json:"name"`
+	Subscribed bool           `json:"subscribed"`
+	Sessions   []debugSession `json:"sessions"`
+}
+
+type debugSession struct {
+	Server    string          `json:"server"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Session   plex.MetadataV1 `json:"session"`
+}
+
+func newDebugSession(session trackedSession) *debugSession {
+	return &debugSession{Server: session.Server, UpdatedAt: session.UpdatedAt, Session: session.Session}
+}
+
+// explain works out what the room is playing the same way for the clock and
+// for /debug/state, logging the decision.
+func (r Room) explain() (roomExplanation, error) {
+	state := roomExplanation{Room: r.Name, Source: r.Source}
+	var err error
+
+	switch {
+	case r.Source != "":
+		state.Decision = decision{branchSource, fmt.Sprintf("room reads from source %v", r.Source)}
+		if src, ok := sources[r.Source]; ok {
+			state.NowPlaying, err = src.NowPlaying(r.Player)
+		} else {
+			err = fmt.Errorf("unknown source %v", r.Source)
+		}
+	case r.AppleTVEntity == "" && r.PlexEntity == "":
+		// Without Home Assistant entities, the room follows its player's
+		// Plex session directly.
+		session, ok := r.plexSession()
+		state.Decision = decision{branchPlayer, fmt.Sprintf("no plex session on player '%v'", r.Player)}
+		if ok {
+			state.PlexStatus.Selected = newDebugSession(session)
+			state.PlexStatus.Matched = true
+			state.NowPlaying = sessionNowPlaying(session)
+			state.Decision.Reason = fmt.Sprintf("session %v is on player '%v'", session.Session.SessionKey, r.Player)
+		}
+	default:
+		err = r.explainStates(&state)
+	}
+
+	if err != nil {
+		state.Error = err.Error()
+		state.Decision = decision{branchError, err.Error()}
+	}
+
+	r.logDecision(state.Decision)
+	return state, err
+}
+
+func (r Room) explainStates(state *roomExplanation) error {
+	atv, err := haStates.GetState(r.AppleTVEntity)
+	if err != nil {
+		return err
+	}
+	state.AppleTV = &atv
+
+	plexHA, err := haStates.GetState(r.PlexEntity)
+	if err != nil {
+		return err
+	}
+	state.PlexHA = &plexHA
+
+	session, matched := selectPlexSession(plexHA)
+	if session.Session.SessionKey != "" {
+		state.PlexStatus.Selected = newDebugSession(session)
+	}
+	state.PlexStatus.Matched = matched
+
+	state.NowPlaying, state.Decision = mergeStates(atv, plexHA, session, matched)
+	return nil
+}
+
+// decisions is the last branch each room took, to log when it changes.
+var decisions = struct {
+	sync.Mutex
+	branches map[string]string
+}{branches: map[string]string{}}
+
+func (r Room) logDecision(d decision) {
+	if d.Branch == branchError {
+		logWarn("now playing failed", "room", r.Name, "error", d.Reason)
+	} else {
+		logDebug("now playing decided", "room", r.Name, "branch", d.Branch, "reason", d.Reason)
+	}
+
+	decisions.Lock()
+	previous, seen := decisions.branches[r.Name]
+	decisions.branches[r.Name] = d.Branch
+	decisions.Unlock()
+
+	if seen && previous != d.Branch {
+		logInfo("now playing branch changed", "room", r.Name, "from", previous, "to", d.Branch, "reason", d.Reason)
+	}
+}
+
+// joinTitles writes a series and episode title as "Series · Title".
+func joinTitles(titles ...string) string {
+	var parts []string
+	for _, title := range titles {
+		if title != "" {
+			parts = append(parts, title)
+		}
+	}
+
+	return strings.Join(parts, " · ")
+}
+
+// debugStateHandler serves /debug/state, explaining what every room, or the
+// one named by ?room=, is showing.
+func debugStateHandler(w http.ResponseWriter, r *http.Request) {
+	rooms := config.Rooms
+	if name := r.URL.Query().Get("room"); name != "" {
+		room, ok := config.findRoom(name)
+		if !ok {
+			writeLametric(w, http.StatusNotFound, errorResponse(fmt.Sprintf("unknown room %v", name)))
+			return
+		}
+		rooms = []Room{room}
+	}
+
+	var servers []plexServerStatus
+	for _, server := range plexServers {
+		status := plexServerStatus{Name: server.name, Subscribed: server.Subscribed(), Sessions: []debugSession{}}
+		for _, session := range server.Sessions() {
+			status.Sessions = append(status.Sessions, *newDebugSession(session))
+		}
+		servers = append(servers, status)
+	}
+
+	states := []roomExplanation{}
+	for _, room := range rooms {
+		state, _ := room.explain()
+		state.PlexStatus.Servers = servers
+		states = append(states, state)
+	}
+
+	body, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		log.Print(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestExplainUnknownSource(t *testing.T) {
+	sources = map[string]source{}
+
+	state, err := Room{Name: "bedroom", Source: "jellyfin"}.explain()
+	if err == nil || err.Error() != "unknown source jellyfin" {
+		t.Errorf("explain = %v", err)
+	}
+
+	if state.Decision.Branch != branchError {
+		t.Errorf("decision = %+v", state.Decision)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	plex "github.com/jrudio/go-plex-client"
+)
+
+const (
+	gdmAddress = "239.0.0.250:32414"
+	gdmTimeout = 2 * time.Second
+
+	// rediscoverInterval is how often a discovered server is checked, and
+	// looked up again if it has stopped answering.
+	rediscoverInterval = 30 * time.Second
+)
+
+// plexCandidate is one way of reaching a Plex server.
+type plexCandidate struct {
+	Name      string
+	MachineID string
+	URL       string
+	Local     bool
+}
+
+// discoverGDM finds servers on the local network using Plex's G'Day Mate
+// multicast protocol.
+func discoverGDM(timeout time.Duration) ([]plexCandidate, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	addr, err := net.ResolveUDPAddr("udp4", gdmAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.WriteToUDP([]byte("M-SEARCH * HTTP/1.1\r\n\r\n"), addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	var candidates []plexCandidate
+	buf := make([]byte, 4096)
+
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// The read deadline is how discovery ends.
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return candidates, nil
+			}
+			return candidates, err
+		}
+
+		candidate, ok := parseGDMResponse(buf[:n], from.IP)
+		if ok {
+			candidates = append(candidates, candidate)
+		}
+	}
+}
+
+// parseGDMResponse reads the HTTP-style headers a server answers a GDM search
+// with.
+func parseGDMResponse(body []byte, ip net.IP) (plexCandidate, bool) {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(body)))
+
+	status, err := reader.ReadLine()
+	if err != nil || !strings.Contains(status, "200") {
+		return plexCandidate{}, false
+	}
+
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return plexCandidate{}, false
+	}
+
+	if header.Get("Content-Type") != "plex/media-server" {
+		return plexCandidate{}, false
+	}
+
+	port := header.Get("Port")
+	if port == "" {
+		port = "32400"
+	}
+
+	return plexCandidate{
+		Name:      header.Get("Name"),
+		MachineID: header.Get("Resource-Identifier"),
+		URL:       "http://" + net.JoinHostPort(ip.String(), port),
+		Local:     true,
+	}, true
+}
+
+// discoverPlexTV lists the connections plex.tv knows for the account's
+// servers, local ones first.
+func discoverPlexTV(token string) ([]plexCandidate, error) {
+	client, err := plex.New("", token)
+	if err != nil {
+		return nil, err
+	}
+
+	servers, err := client.GetServers()
+	if err != nil {
+		return nil, err
+	}
+
+	var local, remote []plexCandidate
+	for _, server := range servers {
+		for _, connection := range server.Connection {
+			candidate := plexCandidate{
+				Name:      server.Name,
+				MachineID: server.ClientIdentifier,
+				URL:       connection.URI,
+				Local:     connection.Local == 1,
+			}
+
+			if candidate.Local {
+				local = append(local, candidate)
+			} else {
+				remote = append(remote, candidate)
+			}
+		}
+	}
+
+	return append(local, remote...), nil
+}
+
+// resolvePlexServer finds a reachable URL for the server named by selector,
+// which may be a server name or machine ID, or empty for the first server
+// found. Servers answering GDM are tried before plex.tv's connections.
+func resolvePlexServer(selector, token string) (string, error) {
+	candidates, err := discoverGDM(gdmTimeout)
+	if err != nil {
+		log.Printf("gdm discovery failed: %v", err)
+	}
+
+	tvCandidates, err := discoverPlexTV(token)
+	if err != nil {
+		log.Printf("plex.tv discovery failed: %v", err)
+	}
+
+	candidates = append(candidates, tvCandidates...)
+
+	for _, candidate := range candidates {
+		if selector != "" && !strings.EqualFold(candidate.Name, selector) && candidate.MachineID != selector {
+			continue
+		}
+
+		err := probePlexServer(candidate.URL, token, candidate.MachineID)
+		if err != nil {
+			log.Printf("plex server %v is not reachable at %v: %v", candidate.Name, candidate.URL, err)
+			continue
+		}
+
+		log.Printf("found plex server %v at %v", candidate.Name, candidate.URL)
+		return candidate.URL, nil
+	}
+
+	if selector == "" {
+		return "", errors.New("no plex servers found")
+	}
+
+	return "", fmt.Errorf("plex server %v not found", selector)
+}
+
+// probePlexServer checks that the server at url answers, and that it is the
+// one expected when machineID is known.
+func probePlexServer(url, token, machineID string) error {
+	client := http.Client{Timeout: 2 * time.Second}
+
+	req, err := http.NewRequest("GET", url+"/identity", nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("X-Plex-Token", token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	var identity struct {
+		MediaContainer struct {
+			MachineIdentifier string `json:"machineIdentifier"`
+		} `json:"MediaContainer"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&identity)
+	if err != nil {
+		return err
+	}
+
+	if machineID != "" && identity.MediaContainer.MachineIdentifier != machineID {
+		return fmt.Errorf("found server %v instead", identity.MediaContainer.MachineIdentifier)
+	}
+
+	return nil
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// eventHistory is how many events are kept for clients resuming with
+	// Last-Event-ID.
+	eventHistory = 256
+	// eventBuffer is how many events a client can fall behind by before it's
+	// disconnected to catch up on its own.
+	eventBuffer = 32
+	// eventHeartbeat is how often idle streams are pinged, which also
+	// notices clients that went away.
+	eventHeartbeat = 15 * time.Second
+	// eventWriteTimeout bounds each write to a stream, in place of the
+	// server's WriteTimeout.
+	eventWriteTimeout = 10 * time.Second
+)
+
+// roomEvent is a change in what a room is playing, as its roomState JSON.
+type roomEvent struct {
+	ID   uint64
+	Room string
+	Data json.RawMessage
+}
+
+// eventClient is one /events stream, following one room or, with no room,
+// all of them. Its events channel is closed when it falls too far behind or
+// the server shuts down.
+type eventClient struct {
+	room   string
+	events chan roomEvent
+}
+
+// eventHub fans room changes out to every stream, keeping the latest state of
+// each room and a ring of recent events to resume from. wake is signalled
+// when a stream starts, so rooms are polled for it straight away.
+type eventHub struct {
+	lock    sync.Mutex
+	nextID  uint64
+	history []roomEvent
+	latest  map[string]roomEvent
+	clients map[*eventClient]bool
+	closed  bool
+	wake    chan struct{}
+}
+
+// IDs start from the time so ones from before a restart are never mistaken
+// for recent ones.
+var nowPlayingEvents = &eventHub{
+	nextID:  uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+	latest:  map[string]roomEvent{},
+	clients: map[*eventClient]bool{},
+	wake:    make(chan struct{}, 1),
+}
+
+// publish records a room's new state and sends it to every stream following
+// the room, dropping streams that have fallen behind.
+func (h *eventHub) publish(room string, data json.RawMessage) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.nextID++
+	event := roomEvent{ID: h.nextID, Room: room, Data: data}
+
+	h.latest[room] = event
+	h.history = append(h.history, event)
+	if len(h.history) > eventHistory {
+		h.history = h.history[len(h.history)-eventHistory:]
+	}
+
+	for client := range h.clients {
+		if client.room != "" && client.room != room {
+			continue
+		}
+
+		select {
+		case client.events <- event:
+		default:
+			following := client.room
+			if following == "" {
+				following = "every room"
+			}
+
+			log.Printf("event stream following %v fell %d events behind, disconnecting it", following, eventBuffer)
+			h.drop(client)
+		}
+	}
+}
+
+// subscribe starts a stream for room, returning the events it missed since
+// lastID, or the latest state of each room when lastID is empty or too old
+// to resume from.
+func (h *eventHub) subscribe(room, lastID string) (*eventClient, []roomEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	client := &eventClient{room: room, events: make(chan roomEvent, eventBuffer)}
+	if h.closed {
+		close(client.events)
+		return client, nil
+	}
+	h.clients[client] = true
+
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+
+	var backlog []roomEvent
+
+	last, err := strconv.ParseUint(lastID, 10, 64)
+	if err == nil && len(h.history) > 0 && last >= h.history[0].ID-1 && last <= h.nextID {
+		for _, event := range h.history {
+			if event.ID > last && (room == "" || event.Room == room) {
+				backlog = append(backlog, event)
+			}
+		}
+
+		return client, backlog
+	}
+
+	for _, event := range h.latest {
+		if room == "" || event.Room == room {
+			backlog = append(backlog, event)
+		}
+	}
+	sort.Slice(backlog, func(i, j int) bool { return backlog[i].ID < backlog[j].ID })
+
+	return client, backlog
+}
+
+// idle reports whether nobody is following any room.
+func (h *eventHub) idle() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return len(h.clients) == 0
+}
+
+func (h *eventHub) unsubscribe(client *eventClient) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.clients[client] {
+		h.drop(client)
+	}
+}
+
+// drop closes a client's stream. The caller holds the lock.
+func (h *eventHub) drop(client *eventClient) {
+	delete(h.clients, client)
+	close(client.events)
+}
+
+// close ends every stream, so shutting down doesn't wait on them.
+func (h *eventHub) close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.closed = true
+	for client := range h.clients {
+		h.drop(client)
+	}
+}
+
+// runEvents polls every room on an interval while anyone is following them,
+// and as soon as someone starts to, and publishes each room's state whenever
+// it changes, until stop is closed.
+func runEvents(rooms []Room, interval time.Duration, stop <-chan struct{}) {
+	last := map[string]string{}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if !nowPlayingEvents.idle() {
+			publishRoomEvents(rooms, last)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-nowPlayingEvents.wake:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// publishRoomEvents publishes the rooms whose state differs from last.
+func publishRoomEvents(rooms []Room, last map[string]string) {
+	for _, room := range rooms {
+		nowPlaying, err := room.NowPlaying()
+		if err != nil {
+			log.Printf("failed to fetch state for room %v: %v", room.Name, err)
+			continue
+		}
+
+		payload, err := json.Marshal(newRoomState(room, nowPlaying))
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		if last[room.Name] == string(payload) {
+			continue
+		}
+
+		last[room.Name] = string(payload)
+		nowPlayingEvents.publish(room.Name, payload)
+	}
+}
+
+// connKey is the context key requests carry their connection under, so
+// streams can set their own write deadlines.
+type connKey struct{}
+
+func withConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// extendWriteDeadline gives the next write to r's connection
+// eventWriteTimeout to finish.
+func extendWriteDeadline(r *http.Request) {
+	if conn, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+		conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+	}
+}
+
+// eventsRoom is the room named by ?room=, or "" for all of them.
+func eventsRoom(r *http.Request) (string, error) {
+	name := r.URL.Query().Get("room")
+	if name == "" {
+		return "", nil
+	}
+
+	room, ok := config.findRoom(name)
+	if !ok {
+		return "", fmt.Errorf("unknown room %v", name)
+	}
+
+	return room.Name, nil
+}
+
+// eventsHandler serves /events, a server-sent event stream of room states.
+// Each event's ID can be sent back as Last-Event-ID to resume after a
+// reconnect.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	room, err := eventsRoom(r)
+	if err != nil {
+		writeLametric(w, http.StatusNotFound, errorResponse(err.Error()))
+		return
+	}
+
+	if !eventsOriginAllowed(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	// EventSource only reads a stream from another site that says it may.
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Add("Vary", "Origin")
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+
+	client, backlog := nowPlayingEvents.subscribe(room, lastID)
+	defer nowPlayingEvents.unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	extendWriteDeadline(r)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	for _, event := range backlog {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-client.events:
+			if !ok {
+				return
+			}
+
+			extendWriteDeadline(r)
+			writeEvent(w, event)
+		case <-heartbeat.C:
+			extendWriteDeadline(r)
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event roomEvent) {
+	fmt.Fprintf(w, "id: %d\nevent: now_playing\ndata: %s\n\n", event.ID, event.Data)
+}
+
+// eventMessage is an event as the websocket sends it.
+type eventMessage struct {
+	ID    uint64          `json:"id"`
+	State json.RawMessage `json:"state"`
+}
+
+var eventUpgrader = websocket.Upgrader{CheckOrigin: eventsOriginAllowed}
+
+// eventsOriginAllowed lets through requests without an Origin, which aren't
+// from browsers, same-origin ones and those from EventsOrigins.
+func eventsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range config.EventsOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// eventsSocketHandler serves /events/ws, the same stream over a websocket,
+// resuming from ?last_event_id= since browsers can't send headers with one.
+func eventsSocketHandler(w http.ResponseWriter, r *http.Request) {
+	room, err := eventsRoom(r)
+	if err != nil {
+		writeLametric(w, http.StatusNotFound, errorResponse(err.Error()))
+		return
+	}
+
+	conn, err := eventUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client, backlog := nowPlayingEvents.subscribe(room, r.URL.Query().Get("last_event_id"))
+	defer nowPlayingEvents.unsubscribe(client)
+
+	// Reading handles pongs and notices the client closing; anything it
+	// sends is ignored.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+
+		conn.SetReadDeadline(time.Now().Add(2 * eventHeartbeat))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(2 * eventHeartbeat))
+		})
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(event roomEvent) error {
+		conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		return conn.WriteJSON(eventMessage{ID: event.ID, State: event.Data})
+	}
+
+	for _, event := range backlog {
+		if send(event) != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-client.events:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "reconnect to resume"), time.Now().Add(time.Second))
+				return
+			}
+
+			if send(event) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventWriteTimeout)) != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
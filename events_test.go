@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// countingSource plays the same thing forever, counting how often it's asked.
+type countingSource struct {
+	lock  sync.Mutex
+	calls int
+}
+
+func (s *countingSource) NowPlaying(player string) (NowPlaying, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.calls++
+	return NowPlaying{ShowTitle: "The Office", Title: "Dinner Party"}, nil
+}
+
+func (s *countingSource) Check() error                { return nil }
+func (s *countingSource) start()                      {}
+func (s *countingSource) close(timeout time.Duration) {}
+
+func (s *countingSource) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.calls
+}
+
+func TestRunEventsOnlyPollsWithStreams(t *testing.T) {
+	src := &countingSource{}
+	sources = map[string]source{"counting": src}
+	defer func() { sources = map[string]source{} }()
+
+	config = Config{}
+	rooms := []Room{{Name: "living", Source: "counting"}}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runEvents(rooms, 10*time.Millisecond, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if src.count() != 0 {
+		t.Fatalf("polled %d times with nobody following", src.count())
+	}
+
+	client, _ := nowPlayingEvents.subscribe("living", "")
+
+	select {
+	case event := <-client.events:
+		if event.Room != "living" {
+			t.Errorf("event for room %q", event.Room)
+		}
+	case <-time.After(scenarioTimeout):
+		t.Fatal("no event after subscribing")
+	}
+
+	nowPlayingEvents.unsubscribe(client)
+
+	// Let a poll that was already running finish.
+	time.Sleep(50 * time.Millisecond)
+	polled := src.count()
+
+	time.Sleep(100 * time.Millisecond)
+	if src.count() != polled {
+		t.Errorf("kept polling after the last stream closed")
+	}
+}
+
+func TestEventsOrigins(t *testing.T) {
+	config = Config{Rooms: []Room{{Name: "living"}}, EventsOrigins: []string{"http://dashboard.lan:8123"}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", eventsHandler)
+	mux.HandleFunc("/events/ws", eventsSocketHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{server.URL, true},
+		{"http://dashboard.lan:8123", true},
+		{"http://elsewhere.example", false},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", server.URL+"/events", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if (resp.StatusCode == http.StatusOK) != test.allowed {
+			t.Errorf("/events from %q = %d", test.origin, resp.StatusCode)
+		}
+
+		if test.allowed && resp.Header.Get("Access-Control-Allow-Origin") != test.origin {
+			t.Errorf("/events from %q allowed origin %q", test.origin, resp.Header.Get("Access-Control-Allow-Origin"))
+		}
+
+		header := http.Header{}
+		if test.origin != "" {
+			header.Set("Origin", test.origin)
+		}
+
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/events/ws", header)
+		if conn != nil {
+			conn.Close()
+		}
+
+		if (err == nil) != test.allowed {
+			t.Errorf("/events/ws from %q: %v", test.origin, err)
+		}
+		if !test.allowed && (resp == nil || resp.StatusCode != http.StatusForbidden) {
+			t.Errorf("/events/ws from %q wasn't forbidden", test.origin)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakePlex stands in for a Plex server: /identity answers, /status/sessions
+// returns whatever sessions it was last given, and its notification websocket
+// announces them.
+type fakePlex struct {
+	server *httptest.Server
+
+	lock     sync.Mutex
+	sessions []json.RawMessage
+	conns    []*websocket.Conn
+}
+
+func newFakePlex() *fakePlex {
+	f := &fakePlex{}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakePlex) serve(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/identity":
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"MediaContainer": {"machineIdentifier": "fake"}}`))
+	case "/status/sessions":
+		f.lock.Lock()
+		sessions := f.sessions
+		f.lock.Unlock()
+
+		if sessions == nil {
+			sessions = []json.RawMessage{}
+		}
+
+		var body struct {
+			MediaContainer struct {
+				Size     int               `json:"size"`
+				Metadata []json.RawMessage `json:"Metadata"`
+			} `json:"MediaContainer"`
+		}
+		body.MediaContainer.Size = len(sessions)
+		body.MediaContainer.Metadata = sessions
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	case "/:/websockets/notifications":
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		f.lock.Lock()
+		f.conns = append(f.conns, conn)
+		f.lock.Unlock()
+
+		// The client only sends keepalives and its close.
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// subscribers is how many notification websockets are open.
+func (f *fakePlex) subscribers() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.conns)
+}
+
+// dropSubscribers closes every notification websocket from the server's end.
+func (f *fakePlex) dropSubscribers() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakePlex) setSessions(sessions []json.RawMessage) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.sessions = sessions
+}
+
+// notify sends a playing notification for each session key, in order.
+func (f *fakePlex) notify(keys []string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, key := range keys {
+		message := fmt.Sprintf(`{"NotificationContainer":{"type":"playing","size":1,"PlaySessionStateNotification":[{"sessionKey":%q,"state":"playing"}]}}`, key)
+		for _, conn := range f.conns {
+			conn.WriteMessage(websocket.TextMessage, []byte(message))
+		}
+	}
+}
+
+func (f *fakePlex) close() {
+	f.lock.Lock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.lock.Unlock()
+
+	f.server.Close()
+}
+
+// fakeHA stands in for Home Assistant: /api/states/<entity> returns the
+// states it was last given, and /api/stream sends a state_changed event for
+// each entity setStates adds, changes or removes, as Home Assistant's
+// server-sent event stream does.
+type fakeHA struct {
+	server *httptest.Server
+
+	lock    sync.Mutex
+	states  map[string]json.RawMessage
+	streams []chan []byte
+}
+
+func newFakeHA() *fakeHA {
+	f := &fakeHA{states: map[string]json.RawMessage{}}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeHA) serve(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/api/":
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"message": "API running."}`))
+	case r.URL.Path == "/api/stream":
+		f.stream(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/states/"):
+		f.lock.Lock()
+		state, ok := f.states[strings.TrimPrefix(r.URL.Path, "/api/states/")]
+		f.lock.Unlock()
+
+		if !ok {
+			http.Error(w, `{"message": "Entity not found."}`, http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(state)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// stream serves /api/stream until the client goes away, starting with the
+// ping Home Assistant opens it with.
+func (f *fakeHA) stream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events := make(chan []byte, 64)
+
+	f.lock.Lock()
+	f.streams = append(f.streams, events)
+	f.lock.Unlock()
+
+	defer func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		for i, stream := range f.streams {
+			if stream == events {
+				f.streams = append(f.streams[:i], f.streams[i+1:]...)
+				break
+			}
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	fmt.Fprint(w, "data: \"ping\"\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+		case event := <-events:
+			fmt.Fprintf(w, "data: %s\n\n", event)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// setStates replaces every state with states, each of which names its
+// entity_id, and announces the ones that differ on the event stream.
+func (f *fakeHA) setStates(states []json.RawMessage) error {
+	byEntity := map[string]json.RawMessage{}
+
+	for _, state := range states {
+		var entity struct {
+			EntityID string `json:"entity_id"`
+		}
+
+		err := json.Unmarshal(state, &entity)
+		if err != nil {
+			return err
+		}
+
+		byEntity[entity.EntityID] = state
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for entity := range byEntity {
+		if _, ok := f.states[entity]; !ok {
+			f.announce(entity, nil, byEntity[entity])
+		}
+	}
+
+	for entity, old := range f.states {
+		if state := byEntity[entity]; !sameJSON(old, state) {
+			f.announce(entity, old, state)
+		}
+	}
+
+	f.states = byEntity
+	return nil
+}
+
+// announce sends a state_changed event to every stream. A nil state is sent
+// as null, the way Home Assistant reports an entity appearing or going away.
+// Callers hold the lock.
+func (f *fakeHA) announce(entity string, old, state json.RawMessage) {
+	event, err := json.Marshal(map[string]interface{}{
+		"event_type": "state_changed",
+		"data": map[string]interface{}{
+			"entity_id": entity,
+			"old_state": nullIfEmpty(old),
+			"new_state": nullIfEmpty(state),
+		},
+	})
+	if err != nil {
+		return
+	}
+
+	for _, stream := range f.streams {
+		select {
+		case stream <- event:
+		default:
+		}
+	}
+}
+
+func nullIfEmpty(raw json.RawMessage) json.RawMessage {
+	if len(raw) == 0 {
+		return json.RawMessage("null")
+	}
+
+	return raw
+}
+
+func (f *fakeHA) close() {
+	// Event streams never finish on their own.
+	f.server.CloseClientConnections()
+	f.server.Close()
+}
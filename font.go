@@ -0,0 +1,106 @@
+package main
+
+// font is the clock's font as bitmaps, one string per row with # for a lit
+// pixel. Rows run from the cap height down to the descender; glyphs leave off
+// trailing blank rows. Widths match glyphWidth.
+var font = map[rune][]string{
+	' ':  {"."},
+	'!':  {"#", "#", "#", ".", "#"},
+	'"':  {"#.#", "#.#"},
+	'#':  {".#.#.", "#####", ".#.#.", "#####", ".#.#."},
+	'$':  {".##", "##.", ".#.", ".##", "##."},
+	'%':  {"#...#", "...#.", "..#..", ".#...", "#...#"},
+	'&':  {".##.", "#...", ".#.#", "#.#.", ".#.#"},
+	'\'': {"#", "#"},
+	'(':  {".#", "#.", "#.", "#.", ".#"},
+	')':  {"#.", ".#", ".#", ".#", "#."},
+	'*':  {"...", "#.#", ".#.", "#.#"},
+	'+':  {"...", ".#.", "###", ".#."},
+	',':  {".", ".", ".", ".", "#", "#"},
+	'-':  {"...", "...", "###"},
+	'.':  {".", ".", ".", ".", "#"},
+	'/':  {"..#", "..#", ".#.", "#..", "#.."},
+	'0':  {"###", "#.#", "#.#", "#.#", "###"},
+	'1':  {".#.", "##.", ".#.", ".#.", "###"},
+	'2':  {"###", "..#", "###", "#..", "###"},
+	'3':  {"###", "..#", ".##", "..#", "###"},
+	'4':  {"#.#", "#.#", "###", "..#", "..#"},
+	'5':  {"###", "#..", "###", "..#", "###"},
+	'6':  {"###", "#..", "###", "#.#", "###"},
+	'7':  {"###", "..#", "..#", ".#.", ".#."},
+	'8':  {"###", "#.#", "###", "#.#", "###"},
+	'9':  {"###", "#.#", "###", "..#", "###"},
+	':':  {".", "#", ".", "#"},
+	';':  {".", "#", ".", ".", "#", "#"},
+	'<':  {"..#", ".#.", "#..", ".#.", "..#"},
+	'=':  {"...", "###", "...", "###"},
+	'>':  {"#..", ".#.", "..#", ".#.", "#.."},
+	'?':  {"###", "..#", ".##", "...", ".#."},
+	'@':  {".###.", "#...#", "#.##.", "#....", ".###."},
+	'A':  {".#.", "#.#", "###", "#.#", "#.#"},
+	'B':  {"##.", "#.#", "##.", "#.#", "##."},
+	'C':  {".##", "#..", "#..", "#..", ".##"},
+	'D':  {"##.", "#.#", "#.#", "#.#", "##."},
+	'E':  {"###", "#..", "##.", "#..", "###"},
+	'F':  {"###", "#..", "##.", "#..", "#.."},
+	'G':  {".##", "#..", "#.#", "#.#", ".##"},
+	'H':  {"#.#", "#.#", "###", "#.#", "#.#"},
+	'I':  {"#", "#", "#", "#", "#"},
+	'J':  {"..#", "..#", "..#", "#.#", ".#."},
+	'K':  {"#.#", "#.#", "##.", "#.#", "#.#"},
+	'L':  {"#..", "#..", "#..", "#..", "###"},
+	'M':  {"#...#", "##.##", "#.#.#", "#...#", "#...#"},
+	'N':  {"#..#", "##.#", "#.##", "#..#", "#..#"},
+	'O':  {".#.", "#.#", "#.#", "#.#", ".#."},
+	'P':  {"##.", "#.#", "##.", "#..", "#.."},
+	'Q':  {".##.", "#..#", "#..#", "#.#.", ".#.#"},
+	'R':  {"##.", "#.#", "##.", "#.#", "#.#"},
+	'S':  {".##", "#..", ".#.", "..#", "##."},
+	'T':  {"###", ".#.", ".#.", ".#.", ".#."},
+	'U':  {"#.#", "#.#", "#.#", "#.#", "###"},
+	'V':  {"#.#", "#.#", "#.#", "#.#", ".#."},
+	'W':  {"#...#", "#...#", "#.#.#", "##.##", "#...#"},
+	'X':  {"#.#", "#.#", ".#.", "#.#", "#.#"},
+	'Y':  {"#.#", "#.#", ".#.", ".#.", ".#."},
+	'Z':  {"###", "..#", ".#.", "#..", "###"},
+	'[':  {"##", "#.", "#.", "#.", "##"},
+	'\\': {"#..", "#..", ".#.", "..#", "..#"},
+	']':  {"##", ".#", ".#", ".#", "##"},
+	'^':  {".#.", "#.#"},
+	'_':  {"...", "...", "...", "...", "###"},
+	'`':  {"#.", ".#"},
+	'a':  {"...", ".##", "#.#", "#.#", ".##"},
+	'b':  {"#..", "##.", "#.#", "#.#", "##."},
+	'c':  {"...", ".##", "#..", "#..", ".##"},
+	'd':  {"..#", ".##", "#.#", "#.#", ".##"},
+	'e':  {"...", ".#.", "###", "#..", ".##"},
+	'f':  {".##", "#..", "##.", "#..", "#.."},
+	'g':  {"...", ".##", "#.#", ".##", "..#", "##."},
+	'h':  {"#..", "##.", "#.#", "#.#", "#.#"},
+	'i':  {"#", ".", "#", "#", "#"},
+	'j':  {".#", "..", ".#", ".#", ".#", "#."},
+	'k':  {"#..", "#.#", "##.", "#.#", "#.#"},
+	'l':  {"#.", "#.", "#.", "#.", ".#"},
+	'm':  {".....", "##.#.", "#.#.#", "#.#.#", "#.#.#"},
+	'n':  {"...", "##.", "#.#", "#.#", "#.#"},
+	'o':  {"...", ".#.", "#.#", "#.#", ".#."},
+	'p':  {"...", "##.", "#.#", "#.#", "##.", "#.."},
+	'q':  {"...", ".##", "#.#", "#.#", ".##", "..#"},
+	'r':  {"...", "#.#", "##.", "#..", "#.."},
+	's':  {"...", ".##", "#..", "..#", "##."},
+	't':  {".#.", "###", ".#.", ".#.", "..#"},
+	'u':  {"...", "#.#", "#.#", "#.#", ".##"},
+	'v':  {"...", "#.#", "#.#", "#.#", ".#."},
+	'w':  {".....", "#...#", "#.#.#", "#.#.#", ".#.#."},
+	'x':  {"...", "#.#", ".#.", ".#.", "#.#"},
+	'y':  {"...", "#.#", "#.#", ".##", "..#", "##."},
+	'z':  {"...", "###", "..#", ".#.", "###"},
+	'{':  {".##", ".#.", "#..", ".#.", ".##"},
+	'|':  {"#", "#", "#", "#", "#"},
+	'}':  {"##.", ".#.", "..#", ".#.", "##."},
+	'~':  {"....", ".#.#", "#.#."},
+	'·':  {".", ".", "#"},
+}
+
+// fontHeight is the rows a glyph can use, descender included.
+const fontHeight = 6
@@ -3,7 +3,7 @@ module github.com/kylegrantlucas/discord-lametric
 go 1.14
 
 require (
-	github.com/gorilla/websocket v1.4.2 // indirect
+	github.com/gorilla/websocket v1.4.2
 	github.com/jrudio/go-plex-client v0.0.0-20190928061814-aa06dc3ae0bd
 	github.com/kylegrantlucas/go-hass v0.0.4
 )
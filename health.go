@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// healthCheck is the result of checking one dependency.
+type healthCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// healthzHandler reports that the process is up and serving.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, healthResponse{Status: "ok"})
+}
+
+// readyzHandler checks every dependency individually: each Plex server's
+// websocket and API, Home Assistant, and each other source.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]healthCheck{}
+
+	for _, server := range plexServers {
+		checks["plex_websocket:"+server.name] = newHealthCheck(server.Subscribed(), "not subscribed")
+
+		client := server.Client()
+		if client == nil {
+			checks["plex_api:"+server.name] = newHealthCheck(false, "not connected")
+			continue
+		}
+
+		checks["plex_api:"+server.name] = errorHealthCheck(probePlexServer(client.URL, server.Token(), ""))
+	}
+
+	if haClient != nil {
+		checks["home_assistant"] = errorHealthCheck(haClient.CheckAPI())
+	}
+
+	for name, src := range sources {
+		checks["source:"+name] = errorHealthCheck(src.Check())
+	}
+
+	response := healthResponse{Status: "ok", Checks: checks}
+	for _, check := range checks {
+		if !check.OK {
+			response.Status = "unavailable"
+		}
+	}
+
+	writeHealth(w, response)
+}
+
+func newHealthCheck(ok bool, reason string) healthCheck {
+	if ok {
+		return healthCheck{OK: true}
+	}
+
+	return healthCheck{Error: reason}
+}
+
+func errorHealthCheck(err error) healthCheck {
+	if err != nil {
+		return healthCheck{Error: err.Error()}
+	}
+
+	return healthCheck{OK: true}
+}
+
+func writeHealth(w http.ResponseWriter, response healthResponse) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		log.Print(err)
+	}
+
+	status := http.StatusOK
+	if response.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"sync"
+
+	plex "github.com/jrudio/go-plex-client"
+)
+
+const defaultIcon = "i24240"
+
+// iconSize is the edge length of a LaMetric icon in pixels.
+const iconSize = 8
+
+// maxCachedIcons bounds the poster cache; it is simply emptied once full.
+const maxCachedIcons = 256
+
+// iconCache holds rendered poster icons keyed by Plex rating key.
+type iconCache struct {
+	sync.Mutex
+	icons map[string]string
+}
+
+var posterIcons = iconCache{icons: map[string]string{}}
+
+// iconFor returns the poster for what's playing as an inline LaMetric icon,
+// falling back to the Plex icon when there is no artwork to show.
+func iconFor(nowPlaying NowPlaying) string {
+	server := findPlexServer(nowPlaying.Server)
+	if server == nil || server.Client() == nil || nowPlaying.RatingKey == "" || nowPlaying.Thumb == "" {
+		return defaultIcon
+	}
+
+	// Rating keys are only unique within a server.
+	icon, err := posterIcons.get(server.Client(), server.name+"/"+nowPlaying.RatingKey, nowPlaying.Thumb)
+	if err != nil {
+		log.Printf("failed to build poster icon for %v: %v", nowPlaying.RatingKey, err)
+		return defaultIcon
+	}
+
+	return icon
+}
+
+func (c *iconCache) get(client *plex.Plex, ratingKey, thumb string) (string, error) {
+	c.Lock()
+	icon, ok := c.icons[ratingKey]
+	c.Unlock()
+
+	if ok {
+		return icon, nil
+	}
+
+	icon, err := fetchPosterIcon(client, thumb)
+	if err != nil {
+		return "", err
+	}
+
+	c.Lock()
+	if len(c.icons) >= maxCachedIcons {
+		c.icons = map[string]string{}
+	}
+	c.icons[ratingKey] = icon
+	c.Unlock()
+
+	return icon, nil
+}
+
+func fetchPosterIcon(client *plex.Plex, thumb string) (string, error) {
+	key, thumbID := client.ExtractKeyAndThumbFromURL(thumb)
+	if key == "" || thumbID == "" {
+		return "", errors.New("unrecognized thumb path " + thumb)
+	}
+
+	resp, err := client.GetThumbnail(key, thumbID)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(resp.Status)
+	}
+
+	poster, _, err := image.Decode(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return encodeIcon(posterToIcon(poster))
+}
+
+// posterToIcon crops the centre square out of a poster, box-filters it down to
+// the icon size and maps every pixel onto the web-safe palette.
+func posterToIcon(poster image.Image) *image.Paletted {
+	bounds := poster.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+
+	origin := image.Pt(
+		bounds.Min.X+(bounds.Dx()-side)/2,
+		bounds.Min.Y+(bounds.Dy()-side)/2,
+	)
+
+	icon := image.NewPaletted(image.Rect(0, 0, iconSize, iconSize), palette.WebSafe)
+	scaled := image.NewRGBA(icon.Rect)
+
+	for y := 0; y < iconSize; y++ {
+		for x := 0; x < iconSize; x++ {
+			cell := image.Rect(
+				origin.X+x*side/iconSize, origin.Y+y*side/iconSize,
+				origin.X+(x+1)*side/iconSize, origin.Y+(y+1)*side/iconSize,
+			)
+			scaled.Set(x, y, averageColor(poster, cell))
+		}
+	}
+
+	draw.Draw(icon, icon.Rect, scaled, image.Point{}, draw.Src)
+
+	return compactPalette(icon)
+}
+
+// compactPalette drops unused palette entries, which keeps the encoded PNG
+// (and so every LaMetric response) small.
+func compactPalette(img *image.Paletted) *image.Paletted {
+	remap := map[uint8]uint8{}
+	var used color.Palette
+
+	for i, index := range img.Pix {
+		newIndex, ok := remap[index]
+		if !ok {
+			newIndex = uint8(len(used))
+			remap[index] = newIndex
+			used = append(used, img.Palette[index])
+		}
+		img.Pix[i] = newIndex
+	}
+
+	img.Palette = used
+	return img
+}
+
+func averageColor(img image.Image, rect image.Rectangle) color.RGBA64 {
+	var r, g, b, a, n uint64
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			cr, cg, cb, ca := img.At(x, y).RGBA()
+			r += uint64(cr)
+			g += uint64(cg)
+			b += uint64(cb)
+			a += uint64(ca)
+			n++
+		}
+	}
+
+	if n == 0 {
+		return color.RGBA64{}
+	}
+
+	return color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)}
+}
+
+func encodeIcon(icon image.Image) (string, error) {
+	var buf bytes.Buffer
+
+	err := png.Encode(&buf, icon)
+	if err != nil {
+		return "", err
+	}
+
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	plex "github.com/jrudio/go-plex-client"
+)
+
+var (
+	posterRed  = color.RGBA{0xff, 0x00, 0x00, 0xff}
+	posterBlue = color.RGBA{0x00, 0x00, 0xff, 0xff}
+)
+
+// testPoster is a portrait poster whose centre square is red on the left and
+// blue on the right, with green bands above and below that the crop drops.
+func testPoster() image.Image {
+	poster := image.NewRGBA(image.Rect(0, 0, 60, 90))
+	for y := 0; y < 90; y++ {
+		for x := 0; x < 60; x++ {
+			c := color.RGBA{0x00, 0xff, 0x00, 0xff}
+			switch {
+			case y < 15 || y >= 75:
+			case x < 30:
+				c = posterRed
+			default:
+				c = posterBlue
+			}
+			poster.Set(x, y, c)
+		}
+	}
+
+	return poster
+}
+
+func TestPosterIcon(t *testing.T) {
+	var fetched int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		png.Encode(w, testPoster())
+	}))
+	defer server.Close()
+
+	client, err := plex.New(server.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := iconCache{icons: map[string]string{}}
+	for i := 0; i < maxCachedIcons; i++ {
+		cache.icons[fmt.Sprint(i)] = defaultIcon
+	}
+
+	// The full cache is emptied to make room.
+	icon, err := cache.get(client, "plex/1234", "/library/metadata/1234/thumb/1700000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fetched != 1 || len(cache.icons) != 1 || cache.icons["plex/1234"] != icon {
+		t.Errorf("after %d fetches the cache holds %d icons", fetched, len(cache.icons))
+	}
+
+	img, ok := decodeIcon(icon).(*image.Paletted)
+	if !ok {
+		t.Fatalf("icon %v is not a paletted PNG", icon)
+	}
+
+	if img.Bounds() != image.Rect(0, 0, iconSize, iconSize) {
+		t.Errorf("icon is %v, want %dx%d", img.Bounds(), iconSize, iconSize)
+	}
+
+	if len(img.Palette) != 2 {
+		t.Errorf("palette has %d colours, want 2", len(img.Palette))
+	}
+
+	for _, test := range []struct {
+		x    int
+		want color.RGBA
+	}{{0, posterRed}, {iconSize - 1, posterBlue}} {
+		for y := 0; y < iconSize; y++ {
+			if got := color.RGBAModel.Convert(img.At(test.x, y)); got != test.want {
+				t.Errorf("pixel %d,%d = %v, want %v", test.x, y, got, test.want)
+			}
+		}
+	}
+
+	// Cached icons aren't fetched again.
+	again, err := cache.get(client, "plex/1234", "/library/metadata/1234/thumb/1700000000")
+	if err != nil || again != icon || fetched != 1 {
+		t.Errorf("second get fetched %d times: %v", fetched, err)
+	}
+}
+
+func TestCompactPalette(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 2, 1), color.Palette{color.Black, posterRed, color.White, posterBlue})
+	img.Pix = []uint8{3, 1}
+
+	compactPalette(img)
+
+	if len(img.Palette) != 2 || !bytes.Equal(img.Pix, []uint8{0, 1}) {
+		t.Fatalf("palette %v, pixels %v", img.Palette, img.Pix)
+	}
+
+	if img.At(0, 0) != color.Color(posterBlue) || img.At(1, 0) != color.Color(posterRed) {
+		t.Errorf("pixels changed colour: %v %v", img.At(0, 0), img.At(1, 0))
+	}
+}
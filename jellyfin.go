@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const jellyfinKeepAlive = 30 * time.Second
+
+// jellyfinSource follows the sessions on a Jellyfin or Emby server, which
+// share an API. It reads /Sessions once, then keeps it current from the
+// server's websocket.
+type jellyfinSource struct {
+	name       string
+	url        string
+	token      string
+	socketPath string
+	client     http.Client
+	stop       chan struct{}
+	done       chan struct{}
+
+	lock      sync.RWMutex
+	conn      *websocket.Conn
+	sessions  []jellyfinSession
+	updatedAt time.Time
+}
+
+type jellyfinSession struct {
+	ID               string `json:"Id"`
+	UserName         string `json:"UserName"`
+	Client           string `json:"Client"`
+	DeviceName       string `json:"DeviceName"`
+	DeviceID         string `json:"DeviceId"`
+	LastActivityDate string `json:"LastActivityDate"`
+	PlayState        struct {
+		PositionTicks    int64 `json:"PositionTicks"`
+		IsPaused         bool  `json:"IsPaused"`
+		AudioStreamIndex *int  `json:"AudioStreamIndex"`
+	} `json:"PlayState"`
+	NowPlayingItem *jellyfinItem `json:"NowPlayingItem"`
+}
+
+type jellyfinItem struct {
+	Name              string `json:"Name"`
+	Type              string `json:"Type"`
+	SeriesName        string `json:"SeriesName"`
+	AlbumArtist       string `json:"AlbumArtist"`
+	ChannelName       string `json:"ChannelName"`
+	ParentIndexNumber int    `json:"ParentIndexNumber"`
+	IndexNumber       int    `json:"IndexNumber"`
+	RunTimeTicks      int64  `json:"RunTimeTicks"`
+	CurrentProgram    *struct {
+		Name string `json:"Name"`
+	} `json:"CurrentProgram"`
+	MediaStreams []jellyfinStream `json:"MediaStreams"`
+}
+
+type jellyfinStream struct {
+	Type           string `json:"Type"`
+	Index          int    `json:"Index"`
+	Codec          string `json:"Codec"`
+	Height         int    `json:"Height"`
+	VideoRange     string `json:"VideoRange"`
+	VideoRangeType string `json:"VideoRangeType"`
+	Channels       int    `json:"Channels"`
+	Profile        string `json:"Profile"`
+	DisplayTitle   string `json:"DisplayTitle"`
+	IsDefault      bool   `json:"IsDefault"`
+}
+
+type jellyfinMessage struct {
+	MessageType string          `json:"MessageType"`
+	Data        json.RawMessage `json:"Data,omitempty"`
+}
+
+func newJellyfinSource(cfg SourceConfig) source {
+	socketPath := "/socket"
+	if strings.EqualFold(cfg.Type, "emby") {
+		socketPath = "/embywebsocket"
+	}
+
+	return &jellyfinSource{
+		name:       cfg.Name,
+		url:        strings.TrimSuffix(cfg.URL, "/"),
+		token:      cfg.Token,
+		socketPath: socketPath,
+		client:     http.Client{Timeout: 10 * time.Second},
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+func (s *jellyfinSource) start() {
+	err := s.refresh()
+	if err != nil {
+		log.Printf("failed to fetch sessions from %v: %v", s.name, err)
+	}
+
+	go func() {
+		defer close(s.done)
+		keepConnected(s.name, 10*time.Second, s.stop, s.listen)
+	}()
+}
+
+func (s *jellyfinSource) close(timeout time.Duration) {
+	close(s.stop)
+
+	s.lock.Lock()
+	if s.conn != nil {
+		s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		s.conn.Close()
+	}
+	s.lock.Unlock()
+
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+	}
+}
+
+func (s *jellyfinSource) Check() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.conn == nil {
+		return errors.New("websocket not connected")
+	}
+
+	return nil
+}
+
+// refresh replaces the sessions with the server's /Sessions.
+func (s *jellyfinSource) refresh() error {
+	req, err := http.NewRequest("GET", s.url+"/Sessions", nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("X-Emby-Token", s.token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	var sessions []jellyfinSession
+	err = json.NewDecoder(resp.Body).Decode(&sessions)
+	if err != nil {
+		return err
+	}
+
+	s.setSessions(sessions)
+	return nil
+}
+
+func (s *jellyfinSource) setSessions(sessions []jellyfinSession) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sessions = sessions
+	s.updatedAt = time.Now()
+}
+
+// listen subscribes to session updates on the websocket until it drops.
+func (s *jellyfinSource) listen() error {
+	socketURL, err := url.Parse(s.url + s.socketPath)
+	if err != nil {
+		return err
+	}
+
+	if socketURL.Scheme == "https" {
+		socketURL.Scheme = "wss"
+	} else {
+		socketURL.Scheme = "ws"
+	}
+
+	socketURL.RawQuery = url.Values{
+		"api_key":  {s.token},
+		"deviceId": {"plex-lametric-" + s.name},
+	}.Encode()
+
+	conn, _, err := websocket.DefaultDialer.Dial(socketURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	select {
+	case <-s.stop:
+		s.lock.Unlock()
+		conn.Close()
+		return nil
+	default:
+	}
+	s.conn = conn
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		s.conn = nil
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	var writeLock sync.Mutex
+	send := func(message jellyfinMessage) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteJSON(message)
+	}
+
+	// Ask for the session list every 1.5s, as the web client does.
+	err = send(jellyfinMessage{MessageType: "SessionsStart", Data: json.RawMessage(`"0,1500"`)})
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(jellyfinKeepAlive)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				send(jellyfinMessage{MessageType: "KeepAlive"})
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		var message jellyfinMessage
+		err := conn.ReadJSON(&message)
+		if err != nil {
+			return err
+		}
+
+		switch message.MessageType {
+		case "Sessions":
+			var sessions []jellyfinSession
+			err := json.Unmarshal(message.Data, &sessions)
+			if err != nil {
+				log.Printf("failed to read sessions from %v: %v", s.name, err)
+				continue
+			}
+
+			s.setSessions(sessions)
+		case "PlaybackStart", "PlaybackStopped":
+			err := s.refresh()
+			if err != nil {
+				log.Printf("failed to fetch sessions from %v: %v", s.name, err)
+			}
+		}
+	}
+}
+
+func (s *jellyfinSource) NowPlaying(player string) (NowPlaying, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	current := s.session(player)
+	if current == nil {
+		return NowPlaying{}, nil
+	}
+
+	return nowPlayingFromJellyfin(*current, s.updatedAt), nil
+}
+
+var jellyfinCommands = map[string]string{
+	actionPlayPause: "PlayPause",
+	actionSkip:      "NextTrack",
+	actionStop:      "Stop",
+}
+
+// Control sends a playback command to the player's session.
+func (s *jellyfinSource) Control(player, action string) error {
+	s.lock.RLock()
+	current := s.session(player)
+	s.lock.RUnlock()
+
+	if current == nil {
+		return errors.New("nothing is playing")
+	}
+
+	req, err := http.NewRequest("POST", s.url+"/Sessions/"+url.PathEscape(current.ID)+"/Playing/"+jellyfinCommands[action], nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("X-Emby-Token", s.token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+
+	return nil
+}
+
+// session is the player's session, or the most recently active one when
+// player is empty. The caller holds the lock.
+func (s *jellyfinSource) session(player string) *jellyfinSession {
+	var current *jellyfinSession
+	var lastActivity time.Time
+
+	for i, session := range s.sessions {
+		if session.NowPlayingItem == nil {
+			continue
+		}
+
+		if !matchesPlayer(player, session.DeviceName, session.DeviceID, session.Client, session.UserName) {
+			continue
+		}
+
+		activity, _ := time.Parse(time.RFC3339Nano, session.LastActivityDate)
+		if current == nil || activity.After(lastActivity) {
+			current = &s.sessions[i]
+			lastActivity = activity
+		}
+	}
+
+	return current
+}
+
+// nowPlayingFromJellyfin maps a session's item and play state the same way
+// buildNowPlaying does for Plex. Ticks are 100ns.
+func nowPlayingFromJellyfin(session jellyfinSession, updatedAt time.Time) NowPlaying {
+	item := session.NowPlayingItem
+
+	nowPlaying := NowPlaying{
+		ShowTitle: item.SeriesName,
+		Title:     item.Name,
+		Duration:  time.Duration(item.RunTimeTicks) * 100,
+		Position:  time.Duration(session.PlayState.PositionTicks) * 100,
+		UpdatedAt: updatedAt,
+		Paused:    session.PlayState.IsPaused,
+		Channel:   item.ChannelName,
+	}
+
+	switch item.Type {
+	case "Episode":
+		nowPlaying.Season = item.ParentIndexNumber
+		nowPlaying.Episode = item.IndexNumber
+	case "Audio":
+		nowPlaying.ShowTitle = item.AlbumArtist
+	case "TvChannel":
+		nowPlaying.Channel = item.Name
+		nowPlaying.Title = ""
+		if item.CurrentProgram != nil {
+			nowPlaying.Title = item.CurrentProgram.Name
+		}
+	}
+
+	nowPlaying.Live = nowPlaying.Duration == 0 || item.Type == "TvChannel"
+	nowPlaying.Progress = progress(float64(nowPlaying.Position), float64(nowPlaying.Duration))
+
+	quality := qualityFromJellyfin(item.MediaStreams, session.PlayState.AudioStreamIndex)
+	if quality.Resolution != "" {
+		nowPlaying.Resolution = &quality.Resolution
+	}
+	if quality != (Quality{}) {
+		nowPlaying.Quality = &quality
+	}
+
+	return nowPlaying
+}
+
+// qualityFromJellyfin reads the video stream and the playing audio stream,
+// or the default one when the server doesn't say which is playing.
+func qualityFromJellyfin(streams []jellyfinStream, audioIndex *int) Quality {
+	var quality Quality
+	var audio *jellyfinStream
+
+	for i, stream := range streams {
+		switch stream.Type {
+		case "Video":
+			quality.Resolution = resolutionFromHeight(stream.Height)
+			quality.VideoCodec = codecName(videoCodecNames, stream.Codec)
+			if stream.VideoRange == "HDR" {
+				quality.DynamicRange = dynamicRange(strings.Replace(stream.VideoRangeType, "Plus", "+", 1) + " " + stream.DisplayTitle)
+			}
+		case "Audio":
+			selected := stream.IsDefault
+			if audioIndex != nil {
+				selected = stream.Index == *audioIndex
+			}
+
+			if audio == nil || selected {
+				audio = &streams[i]
+			}
+		}
+	}
+
+	if audio != nil {
+		quality.AudioCodec = codecName(audioCodecNames, audio.Codec)
+		if audio.Codec == "dts" && strings.Contains(strings.ToLower(audio.Profile), "ma") {
+			quality.AudioCodec = "DTS-HD MA"
+		}
+
+		quality.AudioChannels = channelLayout(audio.Channels)
+		quality.Atmos = strings.Contains(strings.ToLower(audio.DisplayTitle+" "+audio.Profile), "atmos")
+	}
+
+	return quality
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestNowPlayingFromJellyfin(t *testing.T) {
+	updatedAt := time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		session string
+		want    NowPlaying
+	}{
+		{
+			name: "episode",
+			session: `{"PlayState": {"PositionTicks": 6600000000, "IsPaused": true},
+				"NowPlayingItem": {"Name": "Dinner Party", "Type": "Episode", "SeriesName": "The Office", "ParentIndexNumber": 4, "IndexNumber": 13, "RunTimeTicks": 13200000000}}`,
+			want: NowPlaying{
+				ShowTitle: "The Office",
+				Title:     "Dinner Party",
+				Season:    4,
+				Episode:   13,
+				Progress:  0.5,
+				Duration:  22 * time.Minute,
+				Position:  11 * time.Minute,
+				UpdatedAt: updatedAt,
+				Paused:    true,
+			},
+		},
+		{
+			name: "song",
+			session: `{"PlayState": {"PositionTicks": 600000000},
+				"NowPlayingItem": {"Name": "Roygbiv", "Type": "Audio", "AlbumArtist": "Boards of Canada", "RunTimeTicks": 1500000000}}`,
+			want: NowPlaying{
+				ShowTitle: "Boards of Canada",
+				Title:     "Roygbiv",
+				Progress:  0.4,
+				Duration:  150 * time.Second,
+				Position:  60 * time.Second,
+				UpdatedAt: updatedAt,
+			},
+		},
+		{
+			name: "live tv channel",
+			session: `{"PlayState": {"PositionTicks": 600000000},
+				"NowPlayingItem": {"Name": "BBC One", "Type": "TvChannel", "CurrentProgram": {"Name": "The News"}}}`,
+			want: NowPlaying{
+				Title:     "The News",
+				Channel:   "BBC One",
+				Position:  60 * time.Second,
+				UpdatedAt: updatedAt,
+				Live:      true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var session jellyfinSession
+			err := json.Unmarshal([]byte(test.session), &session)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := nowPlayingFromJellyfin(session, updatedAt)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("\ngot  %+v\nwant %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestQualityFromJellyfin(t *testing.T) {
+	trueHD := 2
+
+	tests := []struct {
+		name       string
+		streams    []jellyfinStream
+		audioIndex *int
+		want       Quality
+	}{
+		{
+			name: "playing audio stream",
+			streams: []jellyfinStream{
+				{Type: "Video", Height: 2160, Codec: "hevc", VideoRange: "HDR", VideoRangeType: "DOVIWithHDR10", DisplayTitle: "4K Dolby Vision"},
+				{Type: "Audio", Index: 1, Codec: "eac3", Channels: 6, IsDefault: true},
+				{Type: "Audio", Index: 2, Codec: "truehd", Channels: 8, DisplayTitle: "TrueHD Atmos 7.1"},
+			},
+			audioIndex: &trueHD,
+			want:       Quality{Resolution: "4k", VideoCodec: "HEVC", DynamicRange: "DV", AudioCodec: "TrueHD", AudioChannels: "7.1", Atmos: true},
+		},
+		{
+			name: "default audio stream",
+			streams: []jellyfinStream{
+				{Type: "Video", Height: 1080, Codec: "h264", VideoRange: "SDR"},
+				{Type: "Audio", Index: 1, Codec: "aac", Channels: 2},
+				{Type: "Audio", Index: 2, Codec: "dts", Profile: "DTS-HD MA", Channels: 6, IsDefault: true},
+			},
+			want: Quality{Resolution: "1080p", VideoCodec: "H264", AudioCodec: "DTS-HD MA", AudioChannels: "5.1"},
+		},
+		{
+			name:    "hdr10+ without audio",
+			streams: []jellyfinStream{{Type: "Video", Height: 2160, Codec: "hevc", VideoRange: "HDR", VideoRangeType: "HDR10Plus"}},
+			want:    Quality{Resolution: "4k", VideoCodec: "HEVC", DynamicRange: "HDR10+"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := qualityFromJellyfin(test.streams, test.audioIndex)
+			if got != test.want {
+				t.Errorf("\ngot  %+v\nwant %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// fakeJellyfin serves /Sessions and the session websocket, which it hands to
+// the test once the client asks for sessions.
+type fakeJellyfin struct {
+	server *httptest.Server
+	socket chan *websocket.Conn
+
+	lock     sync.Mutex
+	sessions string
+}
+
+func newFakeJellyfin(sessions string) *fakeJellyfin {
+	f := &fakeJellyfin{sessions: sessions, socket: make(chan *websocket.Conn, 1)}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeJellyfin) serve(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/Sessions":
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(f.sessions))
+	case "/socket":
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		var message jellyfinMessage
+		if conn.ReadJSON(&message) != nil || message.MessageType != "SessionsStart" {
+			conn.Close()
+			return
+		}
+
+		f.socket <- conn
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeJellyfin) setSessions(sessions string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.sessions = sessions
+}
+
+func TestJellyfinWebsocketSessions(t *testing.T) {
+	fake := newFakeJellyfin(`[{"DeviceName": "Bedroom TV", "NowPlayingItem": {"Name": "Dinner Party", "Type": "Movie"}}]`)
+	defer fake.server.Close()
+
+	src := newJellyfinSource(SourceConfig{Name: "jellyfin", Type: "jellyfin", URL: fake.server.URL}).(*jellyfinSource)
+	src.start()
+	defer src.close(time.Second)
+
+	title := func(player string) string {
+		nowPlaying, err := src.NowPlaying(player)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nowPlaying.Title
+	}
+
+	if got := title("Bedroom TV"); got != "Dinner Party" {
+		t.Fatalf("title from /Sessions = %q", got)
+	}
+
+	var conn *websocket.Conn
+	select {
+	case conn = <-fake.socket:
+	case <-time.After(scenarioTimeout):
+		t.Fatal("websocket never connected")
+	}
+
+	// Sessions messages replace the list; the most recently active session
+	// wins when no player is named.
+	conn.WriteJSON(jellyfinMessage{MessageType: "Sessions", Data: json.RawMessage(`[
+		{"DeviceName": "Bedroom TV", "LastActivityDate": "2026-10-19T20:00:00Z", "NowPlayingItem": {"Name": "Stress Relief", "Type": "Movie"}},
+		{"DeviceName": "Living Room", "LastActivityDate": "2026-10-19T20:05:00Z", "NowPlayingItem": {"Name": "Roygbiv", "Type": "Audio"}}
+	]`)})
+
+	err := waitFor(func() bool { return title("Bedroom TV") == "Stress Relief" })
+	if err != nil {
+		t.Fatalf("title after Sessions = %q", title("Bedroom TV"))
+	}
+
+	if got := title(""); got != "Roygbiv" {
+		t.Errorf("most recent title = %q", got)
+	}
+
+	// Playback starting or stopping refetches /Sessions.
+	fake.setSessions(`[]`)
+	conn.WriteJSON(jellyfinMessage{MessageType: "PlaybackStopped"})
+
+	err = waitFor(func() bool { return title("") == "" })
+	if err != nil {
+		t.Errorf("title after PlaybackStopped = %q", title(""))
+	}
+
+	if src.Check() != nil {
+		t.Errorf("Check = %v", src.Check())
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// kodiRefreshInterval resyncs the position in case a notification was missed.
+const kodiRefreshInterval = 30 * time.Second
+
+// kodiSource follows what a Kodi instance is playing over its JSON-RPC
+// websocket (port 9090 by default), asking for the player's item and
+// properties whenever playback changes.
+type kodiSource struct {
+	name string
+	url  string
+	stop chan struct{}
+	done chan struct{}
+
+	lock       sync.RWMutex
+	conn       *websocket.Conn
+	nowPlaying NowPlaying
+	playerID   *int
+
+	callLock sync.Mutex
+	nextID   int
+	pending  map[int]chan kodiResponse
+}
+
+type kodiResponse struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type kodiItem struct {
+	Type          string   `json:"type"`
+	Label         string   `json:"label"`
+	Title         string   `json:"title"`
+	ShowTitle     string   `json:"showtitle"`
+	Season        int      `json:"season"`
+	Episode       int      `json:"episode"`
+	Channel       string   `json:"channel"`
+	Artist        []string `json:"artist"`
+	StreamDetails struct {
+		Video []struct {
+			Codec   string `json:"codec"`
+			Height  int    `json:"height"`
+			HDRType string `json:"hdrtype"`
+		} `json:"video"`
+		Audio []struct {
+			Codec    string `json:"codec"`
+			Channels int    `json:"channels"`
+		} `json:"audio"`
+	} `json:"streamdetails"`
+}
+
+type kodiTime struct {
+	Hours        int `json:"hours"`
+	Minutes      int `json:"minutes"`
+	Seconds      int `json:"seconds"`
+	Milliseconds int `json:"milliseconds"`
+}
+
+func (t kodiTime) Duration() time.Duration {
+	return time.Duration(t.Hours)*time.Hour + time.Duration(t.Minutes)*time.Minute +
+		time.Duration(t.Seconds)*time.Second + time.Duration(t.Milliseconds)*time.Millisecond
+}
+
+type kodiProperties struct {
+	Time               kodiTime `json:"time"`
+	TotalTime          kodiTime `json:"totaltime"`
+	Speed              int      `json:"speed"`
+	Live               bool     `json:"live"`
+	CurrentAudioStream *struct {
+		Codec    string `json:"codec"`
+		Channels int    `json:"channels"`
+	} `json:"currentaudiostream"`
+}
+
+var kodiDynamicRanges = map[string]string{
+	"dolbyvision": "DV",
+	"hdr10":       "HDR10",
+	"hdr10plus":   "HDR10+",
+	"hlg":         "HLG",
+}
+
+func newKodiSource(cfg SourceConfig) source {
+	return &kodiSource{
+		name:    cfg.Name,
+		url:     kodiSocketURL(cfg.URL),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		pending: map[int]chan kodiResponse{},
+	}
+}
+
+// kodiSocketURL accepts a websocket URL, an http one, or a bare host, which
+// gets Kodi's default JSON-RPC port.
+func kodiSocketURL(raw string) string {
+	if !strings.Contains(raw, "://") {
+		raw = "ws://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+
+	if u.Port() == "" {
+		u.Host += ":9090"
+	}
+
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/jsonrpc"
+	}
+
+	return u.String()
+}
+
+func (s *kodiSource) start() {
+	go func() {
+		defer close(s.done)
+		keepConnected(s.name, 10*time.Second, s.stop, s.listen)
+	}()
+}
+
+func (s *kodiSource) close(timeout time.Duration) {
+	close(s.stop)
+
+	s.lock.Lock()
+	if s.conn != nil {
+		s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		s.conn.Close()
+	}
+	s.lock.Unlock()
+
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+	}
+}
+
+func (s *kodiSource) Check() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.conn == nil {
+		return errors.New("websocket not connected")
+	}
+
+	return nil
+}
+
+// NowPlaying ignores player, since a Kodi instance only plays one thing.
+func (s *kodiSource) NowPlaying(player string) (NowPlaying, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.nowPlaying, nil
+}
+
+// listen reads responses and notifications until the websocket drops,
+// refreshing on any playback notification.
+func (s *kodiSource) listen() error {
+	conn, _, err := websocket.DefaultDialer.Dial(s.url, nil)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	select {
+	case <-s.stop:
+		s.lock.Unlock()
+		conn.Close()
+		return nil
+	default:
+	}
+	s.conn = conn
+	s.lock.Unlock()
+
+	refresh := make(chan struct{}, 1)
+	done := make(chan struct{})
+
+	defer func() {
+		close(done)
+
+		s.lock.Lock()
+		s.conn = nil
+		s.nowPlaying = NowPlaying{}
+		s.playerID = nil
+		s.lock.Unlock()
+
+		conn.Close()
+	}()
+
+	poke := func() {
+		select {
+		case refresh <- struct{}{}:
+		default:
+		}
+	}
+
+	// Calls wait on the read loop below, so they run separately from it.
+	go func() {
+		ticker := time.NewTicker(kodiRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			err := s.refresh(conn)
+			if err != nil {
+				log.Printf("failed to fetch player state from %v: %v", s.name, err)
+			}
+
+			select {
+			case <-refresh:
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		var message kodiResponse
+		err := conn.ReadJSON(&message)
+		if err != nil {
+			s.failCalls()
+			return err
+		}
+
+		if message.ID != nil {
+			s.callLock.Lock()
+			reply, ok := s.pending[*message.ID]
+			delete(s.pending, *message.ID)
+			s.callLock.Unlock()
+
+			if ok {
+				reply <- message
+			}
+			continue
+		}
+
+		if strings.HasPrefix(message.Method, "Player.") {
+			poke()
+		}
+	}
+}
+
+// call makes a JSON-RPC request and waits for its response.
+func (s *kodiSource) call(conn *websocket.Conn, method string, params, result interface{}) error {
+	reply := make(chan kodiResponse, 1)
+
+	s.callLock.Lock()
+	s.nextID++
+	id := s.nextID
+	s.pending[id] = reply
+
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	err := conn.WriteJSON(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		delete(s.pending, id)
+	}
+	s.callLock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	select {
+	case response, ok := <-reply:
+		if !ok {
+			return errors.New("connection closed")
+		}
+		if response.Error != nil {
+			return fmt.Errorf("%v: %v", method, response.Error.Message)
+		}
+		return json.Unmarshal(response.Result, result)
+	case <-time.After(10 * time.Second):
+		s.callLock.Lock()
+		delete(s.pending, id)
+		s.callLock.Unlock()
+		return fmt.Errorf("%v: timed out", method)
+	}
+}
+
+// failCalls ends the calls waiting on a dropped connection.
+func (s *kodiSource) failCalls() {
+	s.callLock.Lock()
+	defer s.callLock.Unlock()
+
+	for id, reply := range s.pending {
+		close(reply)
+		delete(s.pending, id)
+	}
+}
+
+// refresh asks Kodi what its active player is playing.
+func (s *kodiSource) refresh(conn *websocket.Conn) error {
+	var players []struct {
+		PlayerID int    `json:"playerid"`
+		Type     string `json:"type"`
+	}
+
+	err := s.call(conn, "Player.GetActivePlayers", map[string]interface{}{}, &players)
+	if err != nil {
+		return err
+	}
+
+	var nowPlaying NowPlaying
+	var playerID *int
+
+	if len(players) > 0 {
+		playerID = &players[0].PlayerID
+
+		var item struct {
+			Item kodiItem `json:"item"`
+		}
+
+		err = s.call(conn, "Player.GetItem", map[string]interface{}{
+			"playerid":   players[0].PlayerID,
+			"properties": []string{"title", "showtitle", "season", "episode", "channel", "artist", "streamdetails"},
+		}, &item)
+		if err != nil {
+			return err
+		}
+
+		var properties kodiProperties
+		err = s.call(conn, "Player.GetProperties", map[string]interface{}{
+			"playerid":   players[0].PlayerID,
+			"properties": []string{"time", "totaltime", "speed", "live", "currentaudiostream"},
+		}, &properties)
+		if err != nil {
+			return err
+		}
+
+		nowPlaying = nowPlayingFromKodi(item.Item, properties, time.Now())
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// A refresh that outlived its connection would undo listen's cleanup.
+	if s.conn != conn {
+		return nil
+	}
+
+	s.nowPlaying = nowPlaying
+	s.playerID = playerID
+
+	return nil
+}
+
+// Control sends a playback command to the active player. Kodi notifies the
+// change, which refreshes what's playing.
+func (s *kodiSource) Control(player, action string) error {
+	s.lock.RLock()
+	conn, playerID := s.conn, s.playerID
+	s.lock.RUnlock()
+
+	if conn == nil {
+		return errors.New("not connected to kodi")
+	}
+
+	if playerID == nil {
+		return errors.New("nothing is playing")
+	}
+
+	params := map[string]interface{}{"playerid": *playerID}
+
+	var method string
+	switch action {
+	case actionPlayPause:
+		method = "Player.PlayPause"
+	case actionSkip:
+		method = "Player.GoTo"
+		params["to"] = "next"
+	case actionStop:
+		method = "Player.Stop"
+	}
+
+	var result interface{}
+	return s.call(conn, method, params, &result)
+}
+
+// nowPlayingFromKodi maps a player's item and properties the same way
+// buildNowPlaying does for Plex.
+func nowPlayingFromKodi(item kodiItem, properties kodiProperties, updatedAt time.Time) NowPlaying {
+	title := item.Title
+	if title == "" {
+		title = item.Label
+	}
+
+	nowPlaying := NowPlaying{
+		ShowTitle: item.ShowTitle,
+		Title:     title,
+		Duration:  properties.TotalTime.Duration(),
+		Position:  properties.Time.Duration(),
+		UpdatedAt: updatedAt,
+		Paused:    properties.Speed == 0,
+	}
+
+	switch item.Type {
+	case "episode":
+		nowPlaying.Season = item.Season
+		nowPlaying.Episode = item.Episode
+	case "song":
+		nowPlaying.ShowTitle = strings.Join(item.Artist, ", ")
+	case "channel":
+		// The label is the channel, the title the programme on it.
+		nowPlaying.Channel = item.Channel
+		if nowPlaying.Channel == "" {
+			nowPlaying.Channel = item.Label
+		}
+		nowPlaying.Title = item.Title
+	}
+
+	nowPlaying.Live = properties.Live || item.Type == "channel" || nowPlaying.Duration == 0
+	nowPlaying.Progress = progress(float64(nowPlaying.Position), float64(nowPlaying.Duration))
+
+	var quality Quality
+	if len(item.StreamDetails.Video) > 0 {
+		video := item.StreamDetails.Video[0]
+		quality.Resolution = resolutionFromHeight(video.Height)
+		quality.VideoCodec = codecName(videoCodecNames, video.Codec)
+		quality.DynamicRange = kodiDynamicRanges[video.HDRType]
+	}
+
+	if audio := properties.CurrentAudioStream; audio != nil && audio.Codec != "" {
+		quality.AudioCodec = codecName(audioCodecNames, audio.Codec)
+		quality.AudioChannels = channelLayout(audio.Channels)
+	} else if len(item.StreamDetails.Audio) > 0 {
+		quality.AudioCodec = codecName(audioCodecNames, item.StreamDetails.Audio[0].Codec)
+		quality.AudioChannels = channelLayout(item.StreamDetails.Audio[0].Channels)
+	}
+
+	if quality.Resolution != "" {
+		nowPlaying.Resolution = &quality.Resolution
+	}
+	if quality != (Quality{}) {
+		nowPlaying.Quality = &quality
+	}
+
+	return nowPlaying
+}
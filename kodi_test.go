@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestKodiSocketURL(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"kodi.lan", "ws://kodi.lan:9090/jsonrpc"},
+		{"kodi.lan:9999", "ws://kodi.lan:9999/jsonrpc"},
+		{"http://kodi.lan", "ws://kodi.lan:9090/jsonrpc"},
+		{"https://kodi.lan:8443/", "wss://kodi.lan:8443/jsonrpc"},
+		{"ws://kodi.lan:9090/jsonrpc", "ws://kodi.lan:9090/jsonrpc"},
+		{"wss://kodi.lan/custom", "wss://kodi.lan:9090/custom"},
+	}
+
+	for _, test := range tests {
+		if got := kodiSocketURL(test.raw); got != test.want {
+			t.Errorf("kodiSocketURL(%q) = %q, want %q", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestNowPlayingFromKodi(t *testing.T) {
+	updatedAt := time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC)
+	resolution := "1080p"
+	resolution4k := "4k"
+
+	tests := []struct {
+		name       string
+		item       string
+		properties string
+		want       NowPlaying
+	}{
+		{
+			name: "episode",
+			item: `{"type": "episode", "label": "4x13. Dinner Party", "title": "Dinner Party", "showtitle": "The Office", "season": 4, "episode": 13,
+				"streamdetails": {"video": [{"codec": "h264", "height": 1080}], "audio": [{"codec": "ac3", "channels": 6}]}}`,
+			properties: `{"time": {"minutes": 11}, "totaltime": {"minutes": 22}, "speed": 1,
+				"currentaudiostream": {"codec": "eac3", "channels": 8}}`,
+			want: NowPlaying{
+				ShowTitle:  "The Office",
+				Title:      "Dinner Party",
+				Season:     4,
+				Episode:    13,
+				Progress:   0.5,
+				Duration:   22 * time.Minute,
+				Position:   11 * time.Minute,
+				UpdatedAt:  updatedAt,
+				Resolution: &resolution,
+				Quality:    &Quality{Resolution: "1080p", VideoCodec: "H264", AudioCodec: "DD+", AudioChannels: "7.1"},
+			},
+		},
+		{
+			name:       "song",
+			item:       `{"type": "song", "label": "Roygbiv", "artist": ["Boards of Canada"]}`,
+			properties: `{"time": {"seconds": 30}, "totaltime": {"minutes": 2, "seconds": 30}, "speed": 0}`,
+			want: NowPlaying{
+				ShowTitle: "Boards of Canada",
+				Title:     "Roygbiv",
+				Progress:  0.2,
+				Duration:  150 * time.Second,
+				Position:  30 * time.Second,
+				UpdatedAt: updatedAt,
+				Paused:    true,
+			},
+		},
+		{
+			name:       "pvr channel",
+			item:       `{"type": "channel", "label": "BBC One", "title": "The News"}`,
+			properties: `{"time": {"minutes": 5}, "totaltime": {"minutes": 30}, "speed": 1, "live": true}`,
+			want: NowPlaying{
+				Title:     "The News",
+				Channel:   "BBC One",
+				Progress:  5.0 / 30,
+				Duration:  30 * time.Minute,
+				Position:  5 * time.Minute,
+				UpdatedAt: updatedAt,
+				Live:      true,
+			},
+		},
+		{
+			name: "audio from stream details",
+			item: `{"type": "movie", "label": "Dune", "title": "Dune",
+				"streamdetails": {"video": [{"codec": "hevc", "height": 2160, "hdrtype": "dolbyvision"}], "audio": [{"codec": "truehd", "channels": 8}]}}`,
+			properties: `{"time": {"hours": 1}, "totaltime": {"hours": 2, "minutes": 35}, "speed": 1, "currentaudiostream": {"codec": "", "channels": 0}}`,
+			want: NowPlaying{
+				Title:      "Dune",
+				Progress:   60.0 / 155,
+				Duration:   155 * time.Minute,
+				Position:   time.Hour,
+				UpdatedAt:  updatedAt,
+				Resolution: &resolution4k,
+				Quality:    &Quality{Resolution: "4k", VideoCodec: "HEVC", DynamicRange: "DV", AudioCodec: "TrueHD", AudioChannels: "7.1"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var item kodiItem
+			err := json.Unmarshal([]byte(test.item), &item)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var properties kodiProperties
+			err = json.Unmarshal([]byte(test.properties), &properties)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := nowPlayingFromKodi(item, properties, updatedAt)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("\ngot  %+v\nwant %+v", got, test.want)
+			}
+		})
+	}
+}
+
+type kodiRequest struct {
+	ID     int    `json:"id"`
+	Method string `json:"method"`
+}
+
+// fakeKodi answers JSON-RPC calls with an episode playing, sending a
+// notification that isn't about playback ahead of every reply. With reverse
+// set it answers calls in pairs, the second first. With hold set it holds
+// Player.GetProperties replies until hold is closed, signalling held.
+type fakeKodi struct {
+	server *httptest.Server
+	held   chan struct{}
+
+	lock    sync.Mutex
+	reverse bool
+	hold    chan struct{}
+
+	writeLock sync.Mutex
+}
+
+func newFakeKodi() *fakeKodi {
+	f := &fakeKodi{held: make(chan struct{}, 1)}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+var kodiResults = map[string]string{
+	"Player.GetActivePlayers": `[{"playerid": 1, "type": "video"}]`,
+	"Player.GetItem":          `{"item": {"type": "episode", "title": "Dinner Party", "showtitle": "The Office", "season": 4, "episode": 13}}`,
+	"Player.GetProperties":    `{"time": {"minutes": 11}, "totaltime": {"minutes": 22}, "speed": 1}`,
+}
+
+func (f *fakeKodi) serve(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var held []kodiRequest
+	for {
+		var request kodiRequest
+		if conn.ReadJSON(&request) != nil {
+			return
+		}
+
+		f.lock.Lock()
+		reverse, hold := f.reverse, f.hold
+		f.lock.Unlock()
+
+		if hold != nil && request.Method == "Player.GetProperties" {
+			f.held <- struct{}{}
+			go func(request kodiRequest) {
+				<-hold
+				f.reply(conn, request.ID, kodiResults[request.Method])
+			}(request)
+			continue
+		}
+
+		held = append(held, request)
+		if reverse && len(held) < 2 {
+			continue
+		}
+
+		for i := len(held) - 1; i >= 0; i-- {
+			// Other methods get their own name back.
+			result, ok := kodiResults[held[i].Method]
+			if !ok {
+				name, _ := json.Marshal(held[i].Method)
+				result = string(name)
+			}
+
+			f.reply(conn, held[i].ID, result)
+		}
+		held = nil
+	}
+}
+
+func (f *fakeKodi) reply(conn *websocket.Conn, id int, result string) {
+	f.writeLock.Lock()
+	defer f.writeLock.Unlock()
+
+	conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "method": "Application.OnVolumeChanged", "params": map[string]interface{}{}})
+	conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": id, "result": json.RawMessage(result)})
+}
+
+func TestKodiWebsocketCalls(t *testing.T) {
+	fake := newFakeKodi()
+	defer fake.server.Close()
+
+	src := newKodiSource(SourceConfig{Name: "kodi", Type: "kodi", URL: fake.server.URL}).(*kodiSource)
+	src.start()
+	defer src.close(time.Second)
+
+	title := func() string {
+		nowPlaying, err := src.NowPlaying("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nowPlaying.ShowTitle + " - " + nowPlaying.Title
+	}
+
+	err := waitFor(func() bool { return title() == "The Office - Dinner Party" })
+	if err != nil {
+		t.Fatalf("title = %q", title())
+	}
+
+	if src.Check() != nil {
+		t.Errorf("Check = %v", src.Check())
+	}
+
+	// Replies are matched to calls by id, whatever order they come back in.
+	fake.lock.Lock()
+	fake.reverse = true
+	fake.lock.Unlock()
+
+	src.lock.RLock()
+	conn := src.conn
+	src.lock.RUnlock()
+
+	var wait sync.WaitGroup
+	for _, method := range []string{"Test.First", "Test.Second"} {
+		wait.Add(1)
+		go func(method string) {
+			defer wait.Done()
+
+			var result string
+			err := src.call(conn, method, map[string]interface{}{}, &result)
+			if err != nil {
+				t.Error(err)
+			}
+			if result != method {
+				t.Errorf("%v got the reply for %v", method, result)
+			}
+		}(method)
+
+		// Make sure the calls go out in order.
+		time.Sleep(20 * time.Millisecond)
+	}
+	wait.Wait()
+}
+
+func TestKodiRefreshAfterDisconnect(t *testing.T) {
+	fake := newFakeKodi()
+	defer fake.server.Close()
+
+	hold := make(chan struct{})
+	fake.hold = hold
+
+	src := newKodiSource(SourceConfig{Name: "kodi", Type: "kodi", URL: fake.server.URL}).(*kodiSource)
+	src.start()
+	defer src.close(time.Second)
+
+	select {
+	case <-fake.held:
+	case <-time.After(scenarioTimeout):
+		t.Fatal("refresh never asked for the player's properties")
+	}
+
+	// The connection is torn down while the refresh waits on its reply, as
+	// listen's cleanup does.
+	src.lock.Lock()
+	conn := src.conn
+	src.conn = nil
+	src.lock.Unlock()
+
+	close(hold)
+	time.Sleep(100 * time.Millisecond)
+
+	nowPlaying, _ := src.NowPlaying("")
+	if !nowPlaying.Idle() {
+		t.Errorf("refresh for a dropped connection set %+v", nowPlaying)
+	}
+
+	src.lock.Lock()
+	src.conn = conn
+	src.lock.Unlock()
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	plex "github.com/jrudio/go-plex-client"
+)
+
+const defaultPlexTVURL = "https://plex.tv"
+
+var errPINPending = errors.New("pin is not authorized yet")
+
+// State is what plex-lametric persists between runs in its state file.
+type State struct {
+	PlexToken        string `json:"plex_token,omitempty"`
+	ClientIdentifier string `json:"client_identifier,omitempty"`
+}
+
+func loadState(path string) (State, error) {
+	var state State
+
+	body, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	return state, json.Unmarshal(body, &state)
+}
+
+// saveState writes the state file atomically, readable only by its owner
+// since it holds the Plex token.
+func saveState(path string, state State) error {
+	body, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".state")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(body)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func newClientIdentifier() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return "plex-lametric-" + hex.EncodeToString(id)
+}
+
+// plexTV requests and checks plex.tv/link PINs. The vendored client's
+// RequestPIN and CheckPIN are hardwired to plex.tv, so this mirrors them
+// against a configurable base URL.
+type plexTV struct {
+	BaseURL          string
+	ClientIdentifier string
+	HTTPClient       http.Client
+}
+
+func newPlexTV(clientIdentifier string) plexTV {
+	baseURL := config.PlexTVURL
+	if baseURL == "" {
+		baseURL = defaultPlexTVURL
+	}
+
+	return plexTV{
+		BaseURL:          baseURL,
+		ClientIdentifier: clientIdentifier,
+		HTTPClient:       http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p plexTV) requestPIN() (plex.PinResponse, error) {
+	var pin plex.PinResponse
+
+	resp, err := p.do("POST", "/api/v2/pins.json")
+	if err != nil {
+		return pin, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return pin, errors.New(resp.Status)
+	}
+
+	return pin, json.NewDecoder(resp.Body).Decode(&pin)
+}
+
+// checkPIN returns errPINPending until the code has been entered on
+// plex.tv/link, and the PIN with its auth token after.
+func (p plexTV) checkPIN(id int) (plex.PinResponse, error) {
+	var pin plex.PinResponse
+
+	resp, err := p.do("GET", fmt.Sprintf("/api/v2/pins/%d.json", id))
+	if err != nil {
+		return pin, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&pin)
+	if err != nil {
+		return pin, err
+	}
+
+	if len(pin.Errors) > 0 {
+		return pin, errors.New(pin.Errors[0].Message)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return pin, errors.New(resp.Status)
+	}
+
+	if pin.AuthToken == "" {
+		return pin, errPINPending
+	}
+
+	return pin, nil
+}
+
+func (p plexTV) do(method, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, p.BaseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("X-Plex-Product", "plex-lametric")
+	req.Header.Add("X-Plex-Client-Identifier", p.ClientIdentifier)
+
+	return p.HTTPClient.Do(req)
+}
+
+// linkState loads the state file, giving it a client identifier if it doesn't
+// have one yet. plex.tv ties PINs and tokens to the identifier.
+func linkState() (State, error) {
+	state, err := loadState(config.StateFile)
+	if err != nil {
+		return state, err
+	}
+
+	if state.ClientIdentifier == "" {
+		state.ClientIdentifier = newClientIdentifier()
+	}
+
+	return state, nil
+}
+
+// runLink implements `plex-lametric link`.
+func runLink(args []string) error {
+	flags := flag.NewFlagSet("link", flag.ExitOnError)
+	flags.Parse(args)
+
+	state, err := linkState()
+	if err != nil {
+		return err
+	}
+
+	tv := newPlexTV(state.ClientIdentifier)
+
+	pin, err := tv.requestPIN()
+	if err != nil {
+		return fmt.Errorf("failed to request a pin from plex.tv: %v", err)
+	}
+
+	fmt.Printf("Go to https://plex.tv/link and enter the code %v\n", pin.Code)
+
+	for {
+		time.Sleep(2 * time.Second)
+
+		pin, err = tv.checkPIN(pin.ID)
+		if err == errPINPending {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to link with plex.tv: %v", err)
+		}
+
+		break
+	}
+
+	state.PlexToken = pin.AuthToken
+	err = saveState(config.StateFile, state)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Linked! The token was saved to %v\n", config.StateFile)
+	return nil
+}
+
+// setup tracks the PIN shown on /setup between page loads.
+var setup struct {
+	sync.Mutex
+	pin   *plex.PinResponse
+	state State
+}
+
+var setupTemplate = template.Must(template.New("setup").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>plex-lametric setup</title>
+{{if .Code}}<meta http-equiv="refresh" content="3">{{end}}
+<style>body { font-family: sans-serif; text-align: center; margin-top: 4em; } code { font-size: 3em; letter-spacing: 0.2em; }</style>
+</head>
+<body>
+{{if .Linked}}
+<p>plex-lametric is linked to your Plex account.</p>
+{{else if .Error}}
+<p>Linking failed: {{.Error}}</p>
+<p><a href="">Try again</a></p>
+{{else}}
+<p>Go to <a href="https://plex.tv/link" target="_blank">plex.tv/link</a> and enter</p>
+<p><code>{{.Code}}</code></p>
+<p>This page will update once you're done.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// setupHandler serves /setup, which links a Plex account from the browser
+// instead of the command line.
+func setupHandler(w http.ResponseWriter, r *http.Request) {
+	page := struct {
+		Linked bool
+		Code   string
+		Error  string
+	}{}
+
+	var err error
+	page.Linked, page.Code, err = advanceSetup()
+	if err != nil {
+		page.Error = err.Error()
+	}
+
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	err = setupTemplate.Execute(w, page)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// advanceSetup moves the browser linking flow along by one page load: it
+// requests a PIN, then checks it until plex.tv reports it authorized.
+func advanceSetup() (linked bool, code string, err error) {
+	setup.Lock()
+	defer setup.Unlock()
+
+	if !needsLink() {
+		return true, "", nil
+	}
+
+	if setup.pin == nil {
+		state, err := linkState()
+		if err != nil {
+			return false, "", err
+		}
+
+		pin, err := newPlexTV(state.ClientIdentifier).requestPIN()
+		if err != nil {
+			return false, "", err
+		}
+
+		setup.pin = &pin
+		setup.state = state
+		return false, pin.Code, nil
+	}
+
+	pin, err := newPlexTV(setup.state.ClientIdentifier).checkPIN(setup.pin.ID)
+	if err == errPINPending {
+		return false, setup.pin.Code, nil
+	}
+
+	setup.pin = nil
+	if err != nil {
+		return false, "", err
+	}
+
+	setup.state.PlexToken = pin.AuthToken
+	err = saveState(config.StateFile, setup.state)
+	if err != nil {
+		return false, "", err
+	}
+
+	for _, server := range plexServers {
+		if server.Token() != "" {
+			continue
+		}
+
+		err = server.connect(pin.AuthToken)
+		if err != nil {
+			return false, "", err
+		}
+	}
+
+	return true, "", nil
+}
+
+// needsLink reports whether any server is still waiting for an account token.
+func needsLink() bool {
+	for _, server := range plexServers {
+		if server.Token() == "" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePlexTV hands out PIN 42, which is authorized once authorize is called.
+type fakePlexTV struct {
+	server *httptest.Server
+
+	lock       sync.Mutex
+	authorized bool
+	requested  int
+	clientIDs  []string
+}
+
+func newFakePlexTV() *fakePlexTV {
+	f := &fakePlexTV{}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakePlexTV) serve(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.clientIDs = append(f.clientIDs, r.Header.Get("X-Plex-Client-Identifier"))
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/api/v2/pins.json":
+		f.requested++
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": 42, "code": "ABCD"}`))
+	case r.Method == "GET" && r.URL.Path == "/api/v2/pins/42.json":
+		if f.authorized {
+			w.Write([]byte(`{"id": 42, "code": "ABCD", "authToken": "account-token"}`))
+		} else {
+			w.Write([]byte(`{"id": 42, "code": "ABCD", "authToken": null}`))
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors": [{"code": 1020, "message": "Code not found or expired"}]}`))
+	}
+}
+
+func (f *fakePlexTV) authorize() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.authorized = true
+}
+
+func TestPlexTVPIN(t *testing.T) {
+	fake := newFakePlexTV()
+	defer fake.server.Close()
+
+	config = Config{PlexTVURL: fake.server.URL}
+	tv := newPlexTV("plex-lametric-test")
+
+	pin, err := tv.requestPIN()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pin.ID != 42 || pin.Code != "ABCD" {
+		t.Fatalf("requestPIN = %+v", pin)
+	}
+
+	_, err = tv.checkPIN(pin.ID)
+	if err != errPINPending {
+		t.Errorf("checkPIN before authorizing = %v", err)
+	}
+
+	fake.authorize()
+
+	pin, err = tv.checkPIN(pin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pin.AuthToken != "account-token" {
+		t.Errorf("checkPIN token = %q", pin.AuthToken)
+	}
+
+	_, err = tv.checkPIN(7)
+	if err == nil || err.Error() != "Code not found or expired" {
+		t.Errorf("checkPIN of an unknown pin = %v", err)
+	}
+
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	for _, id := range fake.clientIDs {
+		if id != "plex-lametric-test" {
+			t.Errorf("client identifier = %q", id)
+		}
+	}
+}
+
+func TestAdvanceSetup(t *testing.T) {
+	fake := newFakePlexTV()
+	defer fake.server.Close()
+
+	plex := newFakePlex()
+	defer plex.close()
+
+	dir, err := ioutil.TempDir("", "plex-lametric")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config = Config{PlexTVURL: fake.server.URL, StateFile: filepath.Join(dir, "state.json")}
+	plexServers = newPlexServers([]PlexServerConfig{{Host: plex.server.URL}}, State{})
+	defer func() {
+		for _, server := range plexServers {
+			server.close(time.Second)
+		}
+		plexServers = nil
+	}()
+
+	// Each page load moves the flow along: request a PIN, show it while it's
+	// pending, then save the token and connect.
+	for i, want := range []struct {
+		linked bool
+		code   string
+	}{
+		{false, "ABCD"},
+		{false, "ABCD"},
+		{true, ""},
+		{true, ""},
+	} {
+		if i == 2 {
+			fake.authorize()
+		}
+
+		linked, code, err := advanceSetup()
+		if err != nil {
+			t.Fatalf("load %d: %v", i, err)
+		}
+
+		if linked != want.linked || code != want.code {
+			t.Errorf("load %d = %v, %q, want %v, %q", i, linked, code, want.linked, want.code)
+		}
+	}
+
+	fake.lock.Lock()
+	requested := fake.requested
+	fake.lock.Unlock()
+
+	if requested != 1 {
+		t.Errorf("requested %d pins, want 1", requested)
+	}
+
+	state, err := loadState(config.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.PlexToken != "account-token" || state.ClientIdentifier == "" {
+		t.Errorf("saved state = %+v", state)
+	}
+
+	if plexServers[0].Token() != "account-token" {
+		t.Errorf("server token = %q", plexServers[0].Token())
+	}
+
+	err = waitFor(func() bool { return plex.subscribers() == 1 })
+	if err != nil {
+		t.Error("linked server never subscribed")
+	}
+}
+
+func TestSetupIsLocalWithoutCredentials(t *testing.T) {
+	config = Config{}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		auth       map[string][]Credential
+		want       int
+	}{
+		{"loopback", "127.0.0.1:50000", nil, http.StatusOK},
+		{"ipv6 loopback", "[::1]:50000", nil, http.StatusOK},
+		{"private", "192.168.1.20:50000", nil, http.StatusOK},
+		{"public", "203.0.113.9:50000", nil, http.StatusForbidden},
+		{"public with credentials", "203.0.113.9:50000", map[string][]Credential{"*": {{Token: "secret"}}}, http.StatusOK},
+		{"local, credentials configured but not sent", "127.0.0.1:50000", map[string][]Credential{"/setup": {{Token: "secret"}}}, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.Auth = test.auth
+
+			req := httptest.NewRequest("GET", "/setup", nil)
+			req.RemoteAddr = test.remoteAddr
+			if test.want == http.StatusOK && test.auth != nil {
+				req.Header.Set("Authorization", "Bearer secret")
+			}
+
+			w := httptest.NewRecorder()
+			requireLocal("/setup", func(w http.ResponseWriter, r *http.Request) {})(w, req)
+
+			if w.Code != test.want {
+				t.Errorf("status = %d, want %d", w.Code, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const defaultLocale = "en"
+
+// messages is the catalog of user-visible strings and formats for a locale.
+type messages struct {
+	Idle         string
+	Live         string
+	Unauthorized string
+
+	// Episode is formatted with the season and episode numbers.
+	Episode string
+
+	// TimeLeft is formatted with the remaining time and the end time, which
+	// are formatted with Hours or Minutes and the Clock layout.
+	TimeLeft string
+	Hours    string
+	Minutes  string
+	Clock    string
+
+	// Stopped is formatted with the user whose stream an admin action or
+	// rule stopped.
+	Stopped string
+}
+
+var catalogs = map[string]messages{
+	"en": {
+		Idle:         "N/A",
+		Live:         "Live",
+		Unauthorized: "Unauthorized",
+		Episode:      "S%02d · E%02d:",
+		TimeLeft:     "%s left · ends %s",
+		Hours:        "%dh %02dm",
+		Minutes:      "%dm",
+		Clock:        "15:04",
+		Stopped:      "Stopped %v's stream",
+	},
+	"de": {
+		Idle:         "Nichts",
+		Live:         "Live",
+		Unauthorized: "Nicht autorisiert",
+		Episode:      "S%02d · F%02d:",
+		TimeLeft:     "noch %s · Ende %s",
+		Hours:        "%d Std %02d Min",
+		Minutes:      "%d Min",
+		Clock:        "15:04",
+		Stopped:      "Stream von %v beendet",
+	},
+	"es": {
+		Idle:         "Nada",
+		Live:         "En directo",
+		Unauthorized: "No autorizado",
+		Episode:      "T%02d · E%02d:",
+		TimeLeft:     "quedan %s · termina %s",
+		Hours:        "%dh %02dmin",
+		Minutes:      "%d min",
+		Clock:        "15:04",
+		Stopped:      "Stream de %v detenido",
+	},
+}
+
+// catalog returns the messages for locale, which may carry a region
+// ("de-AT", "es_MX"), falling back to English.
+func catalog(locale string) messages {
+	locale = strings.ToLower(locale)
+	if m, ok := catalogs[locale]; ok {
+		return m
+	}
+
+	if i := strings.IndexAny(locale, "-_"); i > 0 {
+		if m, ok := catalogs[locale[:i]]; ok {
+			return m
+		}
+	}
+
+	return catalogs[defaultLocale]
+}
+
+// validateLocale reports an error for a locale without a catalog.
+func validateLocale(locale string) error {
+	if locale == "" {
+		return nil
+	}
+
+	lang := strings.ToLower(locale)
+	if i := strings.IndexAny(lang, "-_"); i > 0 {
+		lang = lang[:i]
+	}
+
+	if _, ok := catalogs[lang]; !ok {
+		return fmt.Errorf("unsupported locale %v", locale)
+	}
+
+	return nil
+}
+
+// locale is the room's locale, falling back to the global one.
+func (r Room) locale() string {
+	if r.Locale != "" {
+		return r.Locale
+	}
+
+	return config.Locale
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Log levels, from the most verbose.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// logLevel is the least severe level that gets logged, set by LOG_LEVEL.
+var logLevel = levelInfo
+
+// parseLogLevel reads a level name, defaulting to info.
+func parseLogLevel(name string) (int, error) {
+	if name == "" {
+		return levelInfo, nil
+	}
+
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown log level %v, use one of %v", name, strings.Join(levelNames, ", "))
+}
+
+// logEvent logs msg at level as `level=info msg="..." key=value ...`, taking
+// fields as alternating keys and values.
+func logEvent(level int, msg string, fields ...interface{}) {
+	if level < logLevel {
+		return
+	}
+
+	line := []string{"level=" + levelNames[level], "msg=" + logValue(msg)}
+	for i := 0; i+1 < len(fields); i += 2 {
+		line = append(line, fmt.Sprintf("%v=%v", fields[i], logValue(fmt.Sprint(fields[i+1]))))
+	}
+
+	// Skip logEvent and the level function so the file is the caller's.
+	log.Output(3, strings.Join(line, " "))
+}
+
+// logValue quotes values that wouldn't survive splitting on spaces.
+func logValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \"=\t\n") {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
+
+func logDebug(msg string, fields ...interface{}) { logEvent(levelDebug, msg, fields...) }
+func logInfo(msg string, fields ...interface{})  { logEvent(levelInfo, msg, fields...) }
+func logWarn(msg string, fields ...interface{})  { logEvent(levelWarn, msg, fields...) }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	hass "github.com/kylegrantlucas/go-hass"
+)
+
+// latencyBuckets are the histogram buckets for upstream calls, in seconds.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	plexNotifications = newMetric("counter", "plex_lametric_plex_notifications_total", "Plex playing notifications received.", "server")
+	plexReconnects    = newMetric("counter", "plex_lametric_plex_websocket_reconnects_total", "Times a Plex notification websocket was reopened.", "server")
+	upstreamErrors    = newMetric("counter", "plex_lametric_upstream_errors_total", "Failed calls to Plex and Home Assistant.", "upstream", "call")
+	upstreamLatency   = newHistogram("plex_lametric_upstream_duration_seconds", "How long calls to Plex and Home Assistant took.", latencyBuckets, "upstream", "call")
+	lametricRequests  = newMetric("counter", "plex_lametric_requests_total", "LaMetric polls answered, by room and status code.", "room", "code")
+	roomPlaying       = newMetric("gauge", "plex_lametric_room_playing", "1 if the room's last poll found something playing, 0 if idle or paused.", "room")
+)
+
+// registry is every metric /metrics reports besides the ones it works out
+// when scraped.
+var registry []*metric
+
+// metric is a Prometheus counter, gauge or histogram with labels.
+type metric struct {
+	kind    string
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+// series is a metric's value for one set of label values.
+type series struct {
+	values []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+func newMetric(kind, name, help string, labels ...string) *metric {
+	m := &metric{kind: kind, name: name, help: help, labels: labels, series: map[string]*series{}}
+	registry = append(registry, m)
+	return m
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	m := newMetric("histogram", name, help, labels...)
+	m.buckets = buckets
+	return m
+}
+
+// get returns the series for values, creating it. The caller holds the lock.
+func (m *metric) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{values: values, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+
+	return s
+}
+
+func (m *metric) add(delta float64, values ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.get(values).value += delta
+}
+
+func (m *metric) set(value float64, values ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.get(values).value = value
+}
+
+// observe adds a sample to a histogram. A histogram's value is the sum of its
+// samples.
+func (m *metric) observe(sample float64, values ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s := m.get(values)
+	s.value += sample
+	s.count++
+	for i, bucket := range m.buckets {
+		if sample <= bucket {
+			s.counts[i]++
+		}
+	}
+}
+
+// write renders the metric in the Prometheus text format.
+func (m *metric) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", m.name, m.help, m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%v%v %v\n", m.name, m.labelSet(s.values, "", ""), formatFloat(s.value))
+			continue
+		}
+
+		for i, bucket := range m.buckets {
+			fmt.Fprintf(w, "%v_bucket%v %d\n", m.name, m.labelSet(s.values, "le", formatFloat(bucket)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%v_bucket%v %d\n", m.name, m.labelSet(s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", m.name, m.labelSet(s.values, "", ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%v_count%v %d\n", m.name, m.labelSet(s.values, "", ""), s.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelSet renders values as {label="value",...}, with an extra label if
+// one is named.
+func (m *metric) labelSet(values []string, extra, extraValue string) string {
+	var pairs []string
+	for i, label := range m.labels {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, label, labelEscaper.Replace(values[i])))
+	}
+
+	if extra != "" {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, extra, extraValue))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// observeCall records how long an upstream call that began at start took,
+// and whether it failed.
+func observeCall(upstream, call string, start time.Time, err error) {
+	upstreamLatency.observe(time.Since(start).Seconds(), upstream, call)
+	if err != nil {
+		upstreamErrors.add(1, upstream, call)
+	}
+}
+
+// countRequest records a LaMetric poll of room answered with code, and
+// whether the room was playing.
+func countRequest(room string, code int, nowPlaying *NowPlaying) {
+	lametricRequests.add(1, room, strconv.Itoa(code))
+
+	if nowPlaying == nil {
+		return
+	}
+
+	playing := 0.0
+	if !nowPlaying.Idle() && !nowPlaying.Paused {
+		playing = 1
+	}
+	roomPlaying.set(playing, room)
+}
+
+// timedStates times every state read through it.
+type timedStates struct {
+	next stateReader
+}
+
+func (s timedStates) GetState(entity string) (hass.State, error) {
+	start := time.Now()
+	state, err := s.next.GetState(entity)
+	observeCall("home_assistant", "get_state", start, err)
+	return state, err
+}
+
+// metricsHandler serves every metric in the Prometheus text format. Session
+// gauges are read from the session registries as they are now.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	sessions := &metric{kind: "gauge", name: "plex_lametric_sessions", help: "Plex sessions on each server.", labels: []string{"server"}, series: map[string]*series{}}
+	transcoding := &metric{kind: "gauge", name: "plex_lametric_transcoding_sessions", help: "Plex sessions being transcoded on each server.", labels: []string{"server"}, series: map[string]*series{}}
+
+	for _, server := range plexServers {
+		sessions.set(0, server.name)
+		transcoding.set(0, server.name)
+
+		for _, session := range server.Sessions() {
+			sessions.add(1, server.name)
+			if isTranscoding(session) {
+				transcoding.add(1, server.name)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	for _, m := range append(registry, sessions, transcoding) {
+		m.write(w)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// mqttClient is a minimal MQTT 3.1.1 client. It only supports what the
+// publisher needs: connecting with a last will, QoS 0 publishes and keepalive.
+type mqttClient struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+type mqttOptions struct {
+	ClientID    string
+	Username    string
+	Password    string
+	KeepAlive   time.Duration
+	WillTopic   string
+	WillPayload []byte
+	WillRetain  bool
+}
+
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPingreq    = 0xc0
+	mqttDisconnect = 0xe0
+)
+
+// dialMQTT connects to a broker given as tcp://host:port, ssl://host:port or
+// a bare host:port.
+func dialMQTT(broker string, opts mqttOptions) (*mqttClient, error) {
+	address := broker
+	useTLS := false
+
+	if u, err := url.Parse(broker); err == nil && u.Host != "" {
+		address = u.Host
+		useTLS = u.Scheme == "ssl" || u.Scheme == "tls" || u.Scheme == "mqtts"
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		if useTLS {
+			address = net.JoinHostPort(address, "8883")
+		} else {
+			address = net.JoinHostPort(address, "1883")
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	var conn net.Conn
+	var err error
+	if useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newMQTTClient(conn, opts)
+}
+
+// newMQTTClient performs the CONNECT handshake over an already established
+// connection, which lets an in-process broker be used in place of a real one.
+func newMQTTClient(conn net.Conn, opts mqttOptions) (*mqttClient, error) {
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = 30 * time.Second
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	_, err := conn.Write(encodeConnect(opts))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	packetType, body, err := readMQTTPacket(reader)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if packetType != mqttConnack || len(body) != 2 {
+		conn.Close()
+		return nil, errors.New("mqtt: unexpected reply to connect")
+	}
+
+	if body[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt: connection refused with code %d", body[1])
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	c := &mqttClient{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+
+	go c.readLoop(reader, opts.KeepAlive)
+	go c.keepAlive(opts.KeepAlive)
+
+	return c, nil
+}
+
+// Publish sends a QoS 0 message.
+func (c *mqttClient) Publish(topic string, payload []byte, retain bool) error {
+	header := byte(mqttPublish)
+	if retain {
+		header |= 0x01
+	}
+
+	body := appendMQTTString(nil, topic)
+	body = append(body, payload...)
+
+	return c.write(encodeMQTTPacket(header, body))
+}
+
+// Done is closed once the connection has been lost or closed.
+func (c *mqttClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close sends a DISCONNECT, which tells the broker not to publish the will.
+func (c *mqttClient) Close() error {
+	err := c.write(encodeMQTTPacket(mqttDisconnect, nil))
+	c.shutdown(nil)
+	return err
+}
+
+func (c *mqttClient) write(packet []byte) error {
+	select {
+	case <-c.done:
+		if c.err != nil {
+			return c.err
+		}
+		return errors.New("mqtt: connection closed")
+	default:
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(packet)
+	if err != nil {
+		c.shutdown(err)
+	}
+
+	return err
+}
+
+func (c *mqttClient) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+// readLoop drains broker packets (CONNACK was already handled, so this is
+// only ever PINGRESP) and notices when the connection goes away. Pings go out
+// every half keepalive, so a broker that stays silent for one and a half has
+// stopped answering them.
+func (c *mqttClient) readLoop(reader *bufio.Reader, keepAlive time.Duration) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+
+		_, _, err := readMQTTPacket(reader)
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+	}
+}
+
+func (c *mqttClient) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if c.write(encodeMQTTPacket(mqttPingreq, nil)) != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func encodeConnect(opts mqttOptions) []byte {
+	flags := byte(0x02) // clean session
+	if opts.WillTopic != "" {
+		flags |= 0x04
+		if opts.WillRetain {
+			flags |= 0x20
+		}
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+		if opts.Password != "" {
+			flags |= 0x40
+		}
+	}
+
+	keepAlive := int(opts.KeepAlive / time.Second)
+
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = appendMQTTString(body, opts.ClientID)
+
+	if opts.WillTopic != "" {
+		body = appendMQTTString(body, opts.WillTopic)
+		body = appendMQTTString(body, string(opts.WillPayload))
+	}
+	if opts.Username != "" {
+		body = appendMQTTString(body, opts.Username)
+		if opts.Password != "" {
+			body = appendMQTTString(body, opts.Password)
+		}
+	}
+
+	return encodeMQTTPacket(mqttConnect, body)
+}
+
+func encodeMQTTPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+
+	return append(packet, body...)
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func readMQTTPacket(reader *bufio.Reader) (byte, []byte, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := 0
+	multiplier := 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return header & 0xf0, body, nil
+}
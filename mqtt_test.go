@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectMQTT runs the CONNECT handshake against the broker end of a pipe and
+// returns what the client sent.
+func connectMQTT(t *testing.T, opts mqttOptions, connectLength int) (*mqttClient, net.Conn, []byte) {
+	conn, broker := net.Pipe()
+
+	connect := make(chan []byte, 1)
+	go func() {
+		packet := make([]byte, connectLength)
+		_, err := io.ReadFull(broker, packet)
+		if err != nil {
+			broker.Close()
+			return
+		}
+
+		connect <- packet
+		broker.Write([]byte{mqttConnack, 2, 0, 0})
+	}()
+
+	client, err := newMQTTClient(conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, broker, <-connect
+}
+
+func TestMQTTConnect(t *testing.T) {
+	want := "\x10\x4f" +
+		"\x00\x04MQTT\x04" +
+		"\xe6" + // username, password, will retain, will, clean session
+		"\x00\x1e" + // keepalive of 30 seconds
+		"\x00\x12plex-lametric-test" +
+		"\x00\x1aplex-lametric/availability" +
+		"\x00\x07offline" +
+		"\x00\x04user" +
+		"\x00\x04pass"
+
+	client, broker, got := connectMQTT(t, mqttOptions{
+		ClientID:    "plex-lametric-test",
+		Username:    "user",
+		Password:    "pass",
+		WillTopic:   "plex-lametric/availability",
+		WillPayload: []byte("offline"),
+		WillRetain:  true,
+	}, len(want))
+	defer broker.Close()
+	defer client.shutdown(nil)
+
+	if string(got) != want {
+		t.Errorf("connect packet\ngot  %q\nwant %q", got, want)
+	}
+}
+
+func TestMQTTPublish(t *testing.T) {
+	client, broker, _ := connectMQTT(t, mqttOptions{ClientID: "test"}, 18)
+	defer broker.Close()
+	defer client.shutdown(nil)
+
+	payload := strings.Repeat("x", 200)
+
+	tests := []struct {
+		name   string
+		retain bool
+		want   string
+	}{
+		// 2 + 1 + 200 bytes needs a second remaining length byte.
+		{"retained", true, "\x31\xcb\x01\x00\x01t" + payload},
+		{"not retained", false, "\x30\xcb\x01\x00\x01t" + payload},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			published := make(chan error, 1)
+			go func() {
+				published <- client.Publish("t", []byte(payload), test.retain)
+			}()
+
+			got := make([]byte, len(test.want))
+			_, err := io.ReadFull(broker, got)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := <-published; err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != test.want {
+				t.Errorf("publish packet\ngot  %q\nwant %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMQTTDetectsSilentBroker(t *testing.T) {
+	client, broker, _ := connectMQTT(t, mqttOptions{ClientID: "test", KeepAlive: 100 * time.Millisecond}, 18)
+	defer broker.Close()
+
+	// Read the pings but never answer them.
+	go io.Copy(ioutil.Discard, broker)
+
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		client.shutdown(nil)
+		t.Fatal("client never noticed the broker stopped answering")
+	}
+
+	if err, ok := client.err.(net.Error); !ok || !err.Timeout() {
+		t.Errorf("client error = %v", client.err)
+	}
+}
+
+func TestDiscoveryConfigs(t *testing.T) {
+	cfg := MQTTConfig{TopicPrefix: "plex-lametric", DiscoveryPrefix: "homeassistant"}
+	configs := discoveryConfigs(cfg, Room{Name: "living_room"})
+
+	device := map[string]interface{}{
+		"identifiers":  []interface{}{"plex_lametric"},
+		"name":         "Plex LaMetric",
+		"manufacturer": "plex-lametric",
+	}
+
+	want := map[string]map[string]interface{}{
+		"homeassistant/sensor/plex_lametric_living_room/config": {
+			"unique_id":             "plex_lametric_living_room",
+			"name":                  "Living Room Now Playing",
+			"icon":                  "mdi:plex",
+			"state_topic":           "plex-lametric/living_room/state",
+			"value_template":        "{{ value_json.text }}",
+			"json_attributes_topic": "plex-lametric/living_room/state",
+			"availability_topic":    "plex-lametric/availability",
+			"device":                device,
+		},
+		"homeassistant/sensor/plex_lametric_living_room_progress/config": {
+			"unique_id":           "plex_lametric_living_room_progress",
+			"name":                "Living Room Progress",
+			"icon":                "mdi:progress-clock",
+			"unit_of_measurement": "%",
+			"state_topic":         "plex-lametric/living_room/state",
+			"value_template":      "{{ value_json.percent }}",
+			"availability_topic":  "plex-lametric/availability",
+			"device":              device,
+		},
+	}
+
+	if len(configs) != len(want) {
+		t.Fatalf("got %d discovery configs, want %d", len(configs), len(want))
+	}
+
+	for topic, payload := range configs {
+		var got map[string]interface{}
+		err := json.NewDecoder(bytes.NewReader(payload)).Decode(&got)
+		if err != nil {
+			t.Fatalf("%v: %v", topic, err)
+		}
+
+		if !reflect.DeepEqual(got, want[topic]) {
+			t.Errorf("%v\ngot  %v\nwant %v", topic, got, want[topic])
+		}
+	}
+}
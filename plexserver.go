@@ -0,0 +1,437 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	plex "github.com/jrudio/go-plex-client"
+	hass "github.com/kylegrantlucas/go-hass"
+)
+
+// plexServers are all the configured servers, whether connected yet or not.
+var plexServers []*plexServer
+
+// plexServer is a connection to one Plex server: its client, its notification
+// websocket, and a registry of the sessions currently playing on it.
+type plexServer struct {
+	name     string
+	host     string
+	selector string
+
+	lock       sync.RWMutex
+	token      string
+	client     *plex.Plex
+	interrupt  chan os.Signal
+	closed     chan struct{}
+	subscribed bool
+	watching   bool
+	sessions   map[string]trackedSession
+}
+
+// trackedSession is a session and when a notification last mentioned it.
+type trackedSession struct {
+	Server    string
+	Session   plex.MetadataV1
+	UpdatedAt time.Time
+}
+
+// newPlexServers builds the configured servers. Servers without a token of
+// their own use the account token saved by linking.
+func newPlexServers(servers []PlexServerConfig, state State) []*plexServer {
+	var result []*plexServer
+
+	for _, server := range servers {
+		token := server.Token
+		if token == "" {
+			token = state.PlexToken
+		}
+
+		name := server.Name
+		for _, fallback := range []string{server.Server, server.Host, "plex"} {
+			if name == "" {
+				name = fallback
+			}
+		}
+
+		result = append(result, &plexServer{
+			name:     name,
+			host:     server.Host,
+			selector: server.Server,
+			token:    token,
+			sessions: map[string]trackedSession{},
+		})
+	}
+
+	return result
+}
+
+func findPlexServer(name string) *plexServer {
+	for _, server := range plexServers {
+		if server.name == name {
+			return server
+		}
+	}
+
+	return nil
+}
+
+func (s *plexServer) Client() *plex.Plex {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.client
+}
+
+func (s *plexServer) Token() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.token
+}
+
+// Subscribed reports whether the notification websocket is connected.
+func (s *plexServer) Subscribed() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.subscribed
+}
+
+// connect starts talking to the server with token, discovering it first when
+// it has no host configured.
+func (s *plexServer) connect(token string) error {
+	s.lock.Lock()
+	s.token = token
+	if !s.watching {
+		s.watching = true
+		go s.watch()
+	}
+	s.lock.Unlock()
+
+	if s.host != "" {
+		return s.start(s.host)
+	}
+
+	host, err := resolvePlexServer(s.selector, token)
+	if err != nil {
+		return err
+	}
+
+	return s.start(host)
+}
+
+// configuredPlexServers builds the configured servers with the tokens saved
+// by linking. Without any configured, a linked account's server is
+// discovered, as is one for rooms that read from Plex so that it can be
+// linked; setups that only use other sources get none.
+func configuredPlexServers() ([]*plexServer, error) {
+	state, err := loadState(config.StateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	servers := config.PlexServers
+	if len(servers) == 0 && (state.PlexToken != "" || config.usesPlex()) {
+		servers = []PlexServerConfig{{}}
+	}
+
+	return newPlexServers(servers, state), nil
+}
+
+// dial connects a client to the server without subscribing to its
+// notifications, for one-off commands.
+func (s *plexServer) dial() (*plex.Plex, error) {
+	if s.Token() == "" {
+		return nil, errors.New("no plex token, run `plex-lametric link`")
+	}
+
+	host := s.host
+	if host == "" {
+		var err error
+		host, err = resolvePlexServer(s.selector, s.Token())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := plex.New(host, s.Token())
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = client.Test()
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// start connects to the server at host and subscribes to its notifications,
+// replacing any previous connection.
+func (s *plexServer) start(host string) error {
+	client, err := plex.New(host, s.Token())
+	if err != nil {
+		return err
+	}
+
+	// client.Test asks plex.tv, so ask the server itself.
+	err = probePlexServer(host, s.Token(), "")
+	if err != nil {
+		return err
+	}
+
+	log.Printf("connected to plex server %v at %v", s.name, host)
+
+	s.subscribe(client)
+	return nil
+}
+
+// subscribe makes client the server's connection and follows its
+// notifications, replacing any previous subscription.
+func (s *plexServer) subscribe(client *plex.Plex) {
+	interrupt := make(chan os.Signal, 1)
+	closed := make(chan struct{})
+	var closeOnce sync.Once
+
+	// Any websocket error, including the one from closing it, ends the
+	// subscription.
+	onError := func(err error) {
+		s.lock.Lock()
+		if s.interrupt == interrupt {
+			s.subscribed = false
+		}
+		s.lock.Unlock()
+
+		closeOnce.Do(func() { close(closed) })
+		log.Printf("plex server %v: %v", s.name, err)
+	}
+
+	events := plex.NewNotificationEvents()
+	events.OnPlaying(func(n plex.NotificationContainer) {
+		s.onPlaying(client.GetSessions, n)
+	})
+
+	s.lock.Lock()
+	previous := s.interrupt
+	s.client = client
+	s.interrupt = interrupt
+	s.closed = closed
+	s.subscribed = true
+	s.lock.Unlock()
+
+	if previous != nil {
+		plexReconnects.add(1, s.name)
+		select {
+		case previous <- os.Interrupt:
+		default:
+		}
+	}
+
+	client.SubscribeToNotifications(events, interrupt, onError)
+}
+
+// close shuts the notification websocket, waiting up to timeout for the
+// server to acknowledge.
+func (s *plexServer) close(timeout time.Duration) {
+	s.lock.Lock()
+	interrupt, closed := s.interrupt, s.closed
+	s.subscribed = false
+	s.lock.Unlock()
+
+	if interrupt == nil {
+		return
+	}
+
+	select {
+	case interrupt <- os.Interrupt:
+	default:
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(timeout):
+	}
+}
+
+// onPlaying refreshes the session registry with fetch whenever a session
+// changes state.
+func (s *plexServer) onPlaying(fetch func() (plex.CurrentSessions, error), n plex.NotificationContainer) {
+	traffic.record(recordedEvent{Type: recordPlexNotification, Server: s.name}, n, nil)
+	plexNotifications.add(1, s.name)
+
+	if len(n.PlaySessionStateNotification) == 0 {
+		return
+	}
+
+	sessionID := n.PlaySessionStateNotification[0].SessionKey
+
+	start := time.Now()
+	sessions, err := fetch()
+	observeCall("plex", "get_sessions", start, err)
+	traffic.record(recordedEvent{Type: recordPlexSessions, Server: s.name}, sessions, err)
+	if err != nil {
+		log.Printf("failed to fetch sessions on plex server %v: %v\n", s.name, err)
+		return
+	}
+
+	s.updateSessions(sessions.MediaContainer.Metadata, sessionID, clock())
+}
+
+// updateSessions replaces the registry with the server's current sessions,
+// marking the one a notification was about as just updated.
+func (s *plexServer) updateSessions(sessions []plex.MetadataV1, notified string, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	current := map[string]trackedSession{}
+	for _, session := range sessions {
+		tracked := trackedSession{
+			Server:    s.name,
+			Session:   session,
+			UpdatedAt: s.sessions[session.SessionKey].UpdatedAt,
+		}
+
+		if session.SessionKey == notified || tracked.UpdatedAt.IsZero() {
+			tracked.UpdatedAt = now
+		}
+
+		current[session.SessionKey] = tracked
+	}
+
+	s.sessions = current
+}
+
+func (s *plexServer) Sessions() []trackedSession {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var sessions []trackedSession
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+
+	return sessions
+}
+
+// allPlexSessions merges the session registries of every server.
+func allPlexSessions() []trackedSession {
+	var sessions []trackedSession
+	for _, server := range plexServers {
+		sessions = append(sessions, server.Sessions()...)
+	}
+
+	return sessions
+}
+
+// selectPlexSession picks the session to show alongside a room's Plex entity:
+// the one whose titles match what Home Assistant reports, otherwise the most
+// recently updated one. matched reports whether the titles matched.
+func selectPlexSession(plexHA hass.State) (session trackedSession, matched bool) {
+	var seriesTitle, title string
+	if plexHA.Attributes.MediaSeriesTitle != nil {
+		seriesTitle = *plexHA.Attributes.MediaSeriesTitle
+	}
+	if plexHA.Attributes.MediaTitle != nil {
+		title = *plexHA.Attributes.MediaTitle
+	}
+
+	for _, candidate := range allPlexSessions() {
+		if candidate.Session.GrandparentTitle == seriesTitle && candidate.Session.Title == title {
+			if !matched || candidate.UpdatedAt.After(session.UpdatedAt) {
+				session = candidate
+				matched = true
+			}
+			continue
+		}
+
+		if !matched && candidate.UpdatedAt.After(session.UpdatedAt) {
+			session = candidate
+		}
+	}
+
+	return session, matched
+}
+
+// plexSession is the session on the room's player, or the most recently
+// updated one when the room doesn't name a player.
+func (r Room) plexSession() (session trackedSession, ok bool) {
+	for _, candidate := range allPlexSessions() {
+		player := candidate.Session.Player
+		if !matchesPlayer(r.Player, player.Title, player.Device, player.Product, player.MachineIdentifier) {
+			continue
+		}
+
+		if !ok || candidate.UpdatedAt.After(session.UpdatedAt) {
+			session = candidate
+			ok = true
+		}
+	}
+
+	return session, ok
+}
+
+// plexAvailable reports whether every server's websocket is connected.
+func plexAvailable() bool {
+	for _, server := range plexServers {
+		if !server.Subscribed() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// watch keeps the server's notification websocket open, checking on it
+// every rediscoverInterval.
+func (s *plexServer) watch() {
+	for range time.Tick(rediscoverInterval) {
+		s.check()
+	}
+}
+
+// check resubscribes when the websocket has dropped. A server that no longer
+// answers at its address is retried at its configured host, or rediscovered.
+func (s *plexServer) check() {
+	token := s.Token()
+	client := s.Client()
+
+	if client != nil && probePlexServer(client.URL, token, "") == nil {
+		if !s.Subscribed() {
+			log.Printf("plex server %v: notification websocket dropped, resubscribing", s.name)
+			s.subscribe(client)
+		}
+		return
+	}
+
+	if s.host != "" {
+		if s.Subscribed() {
+			return
+		}
+
+		err := s.start(s.host)
+		if err != nil {
+			log.Printf("failed to reconnect to plex server %v at %v: %v", s.name, s.host, err)
+		}
+		return
+	}
+
+	url, err := resolvePlexServer(s.selector, token)
+	if err != nil {
+		log.Printf("failed to rediscover plex server %v: %v", s.name, err)
+		return
+	}
+
+	if client != nil && strings.TrimSuffix(url, "/") == strings.TrimSuffix(client.URL, "/") && s.Subscribed() {
+		return
+	}
+
+	err = s.start(url)
+	if err != nil {
+		log.Printf("failed to reconnect to plex server %v at %v: %v", s.name, url, err)
+	}
+}
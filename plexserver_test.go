@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	plex "github.com/jrudio/go-plex-client"
+)
+
+func TestConfiguredPlexServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plex-lametric")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stateFile := filepath.Join(dir, "state.json")
+	sourceRoom := Room{Name: "bedroom", Source: "jellyfin"}
+	plexRoom := Room{Name: "living", Player: "Living Room"}
+
+	tests := []struct {
+		name   string
+		config Config
+		linked bool
+		want   int
+	}{
+		{"sources only", Config{Rooms: []Room{sourceRoom}}, false, 0},
+		{"sources only, linked", Config{Rooms: []Room{sourceRoom}}, true, 1},
+		{"a room reads plex", Config{Rooms: []Room{sourceRoom, plexRoom}}, false, 1},
+		{"configured", Config{Rooms: []Room{sourceRoom}, PlexServers: []PlexServerConfig{{Host: "http://plex:32400"}, {Server: "nas"}}}, false, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Remove(stateFile)
+			if test.linked {
+				err := saveState(stateFile, State{PlexToken: "token"})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			config = test.config
+			config.StateFile = stateFile
+
+			servers, err := configuredPlexServers()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(servers) != test.want {
+				t.Errorf("got %d servers, want %d", len(servers), test.want)
+			}
+		})
+	}
+}
+
+func TestCheckResubscribesDroppedWebsocket(t *testing.T) {
+	fake := newFakePlex()
+	defer fake.close()
+
+	client, err := plex.New(fake.server.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &plexServer{name: "plex", host: fake.server.URL, token: "token", sessions: map[string]trackedSession{}}
+	server.subscribe(client)
+	defer server.close(time.Second)
+
+	err = waitFor(func() bool { return fake.subscribers() == 1 })
+	if err != nil {
+		t.Fatal("websocket never connected")
+	}
+
+	// The server still answers, so only the websocket is reopened.
+	fake.dropSubscribers()
+	err = waitFor(func() bool { return !server.Subscribed() })
+	if err != nil {
+		t.Fatal("dropped websocket still counted as subscribed")
+	}
+
+	server.check()
+
+	err = waitFor(func() bool { return fake.subscribers() == 1 && server.Subscribed() })
+	if err != nil {
+		t.Fatal("websocket never reopened")
+	}
+
+	if server.Client() != client {
+		t.Error("check replaced the client of a reachable server")
+	}
+}
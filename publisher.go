@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// roomState is the JSON document published for each room.
+type roomState struct {
+	Room             string     `json:"room"`
+	State            string     `json:"state"`
+	Text             string     `json:"text"`
+	Percent          int        `json:"percent"`
+	RemainingSeconds int        `json:"remaining_seconds,omitempty"`
+	EndsAt           *time.Time `json:"ends_at,omitempty"`
+	NowPlaying
+}
+
+func newRoomState(room Room, nowPlaying NowPlaying) roomState {
+	now := clock()
+
+	state := roomState{
+		Room:       room.Name,
+		State:      "playing",
+		Text:       room.text(nowPlaying, room.displayOptions(), now),
+		Percent:    int(nowPlaying.Progress * 100),
+		NowPlaying: nowPlaying,
+	}
+
+	switch {
+	case nowPlaying.Idle():
+		state.State = "idle"
+	case nowPlaying.Paused:
+		state.State = "paused"
+	}
+
+	if nowPlaying.Duration > 0 {
+		// Whole minutes keep the retained message from changing every poll.
+		remaining := nowPlaying.Remaining(now).Round(time.Minute)
+		endsAt := now.Add(remaining).In(room.location()).Truncate(time.Minute)
+
+		state.RemainingSeconds = int(remaining.Seconds())
+		state.EndsAt = &endsAt
+	}
+
+	return state
+}
+
+var errPublisherStopped = errors.New("publisher stopped")
+
+// runMQTTPublisher polls every room on an interval and publishes retained
+// state and availability messages, reconnecting whenever the broker drops,
+// until stop is closed.
+func runMQTTPublisher(cfg MQTTConfig, rooms []Room, stop <-chan struct{}) {
+	if cfg.TopicPrefix == "" {
+		cfg.TopicPrefix = "plex-lametric"
+	}
+
+	if cfg.DiscoveryPrefix == "" {
+		cfg.DiscoveryPrefix = "homeassistant"
+	}
+
+	if cfg.ClientID == "" {
+		hostname, _ := os.Hostname()
+		cfg.ClientID = "plex-lametric-" + hostname
+	}
+
+	interval := parseInterval(cfg.Interval, 5*time.Second)
+	availabilityTopic := cfg.TopicPrefix + "/availability"
+
+	for {
+		client, err := dialMQTT(cfg.Broker, mqttOptions{
+			ClientID:    cfg.ClientID,
+			Username:    cfg.Username,
+			Password:    cfg.Password,
+			WillTopic:   availabilityTopic,
+			WillPayload: []byte("offline"),
+			WillRetain:  true,
+		})
+		if err == nil {
+			err = publishRooms(client, cfg, rooms, interval, stop)
+			if err == errPublisherStopped {
+				// A clean disconnect doesn't trigger the will, so say so ourselves.
+				client.Publish(availabilityTopic, []byte("offline"), true)
+				client.Close()
+				return
+			}
+
+			log.Printf("mqtt connection lost: %v", err)
+			client.Close()
+		} else {
+			log.Printf("failed to connect to mqtt broker: %v", err)
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func publishRooms(client *mqttClient, cfg MQTTConfig, rooms []Room, interval time.Duration, stop <-chan struct{}) error {
+	availabilityTopic := cfg.TopicPrefix + "/availability"
+
+	for _, room := range rooms {
+		for topic, payload := range discoveryConfigs(cfg, room) {
+			err := client.Publish(topic, payload, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	lastPayloads := map[string]string{}
+
+	publish := func(topic string, payload []byte) error {
+		if lastPayloads[topic] == string(payload) {
+			return nil
+		}
+
+		err := client.Publish(topic, payload, true)
+		if err != nil {
+			return err
+		}
+
+		lastPayloads[topic] = string(payload)
+		return nil
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		available := plexAvailable()
+
+		for _, room := range rooms {
+			nowPlaying, err := room.NowPlaying()
+			if err != nil {
+				log.Printf("failed to fetch state for room %v: %v", room.Name, err)
+				available = false
+				continue
+			}
+
+			payload, err := json.Marshal(newRoomState(room, nowPlaying))
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+
+			err = publish(roomTopic(cfg, room)+"/state", payload)
+			if err != nil {
+				return err
+			}
+		}
+
+		availability := "offline"
+		if available {
+			availability = "online"
+		}
+
+		err := publish(availabilityTopic, []byte(availability))
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-client.Done():
+			return client.err
+		case <-stop:
+			return errPublisherStopped
+		}
+	}
+}
+
+func roomTopic(cfg MQTTConfig, room Room) string {
+	return cfg.TopicPrefix + "/" + slug(room.Name)
+}
+
+// discoveryConfigs builds the Home Assistant MQTT discovery messages for a
+// room, keyed by topic.
+func discoveryConfigs(cfg MQTTConfig, room Room) map[string][]byte {
+	id := "plex_lametric_" + slug(room.Name)
+	stateTopic := roomTopic(cfg, room) + "/state"
+	roomName := strings.Title(strings.Replace(room.Name, "_", " ", -1))
+
+	device := map[string]interface{}{
+		"identifiers":  []string{"plex_lametric"},
+		"name":         "Plex LaMetric",
+		"manufacturer": "plex-lametric",
+	}
+
+	sensors := map[string]map[string]interface{}{
+		id: {
+			"name":                  roomName + " Now Playing",
+			"icon":                  "mdi:plex",
+			"value_template":        "{{ value_json.text }}",
+			"json_attributes_topic": stateTopic,
+		},
+		id + "_progress": {
+			"name":                roomName + " Progress",
+			"icon":                "mdi:progress-clock",
+			"unit_of_measurement": "%",
+			"value_template":      "{{ value_json.percent }}",
+		},
+	}
+
+	configs := map[string][]byte{}
+	for uniqueID, sensor := range sensors {
+		sensor["unique_id"] = uniqueID
+		sensor["state_topic"] = stateTopic
+		sensor["availability_topic"] = cfg.TopicPrefix + "/availability"
+		sensor["device"] = device
+
+		payload, err := json.Marshal(sensor)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		configs[cfg.DiscoveryPrefix+"/sensor/"+uniqueID+"/config"] = payload
+	}
+
+	return configs
+}
+
+func slug(name string) string {
+	return strings.ToLower(strings.Join(strings.FieldsFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}), "_"))
+}
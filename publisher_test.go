@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoomStateUsesClock(t *testing.T) {
+	recorded := time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return recorded.Add(time.Minute) }
+	defer func() { clock = time.Now }()
+
+	nowPlaying := NowPlaying{Title: "Dinner Party", Duration: 22 * time.Minute, Position: 11 * time.Minute, UpdatedAt: recorded}
+	state := newRoomState(Room{Name: "living", Timezone: "UTC"}, nowPlaying)
+
+	if state.RemainingSeconds != 600 {
+		t.Errorf("remaining_seconds = %d, want 600", state.RemainingSeconds)
+	}
+
+	if state.EndsAt == nil || !state.EndsAt.Equal(recorded.Add(11*time.Minute)) {
+		t.Errorf("ends_at = %v", state.EndsAt)
+	}
+}
+
+func TestRoomStateStates(t *testing.T) {
+	tests := []struct {
+		nowPlaying NowPlaying
+		want       string
+	}{
+		{NowPlaying{Title: "Dinner Party"}, "playing"},
+		{NowPlaying{Title: "Dinner Party", Paused: true}, "paused"},
+		{NowPlaying{}, "idle"},
+	}
+
+	for _, test := range tests {
+		if got := newRoomState(Room{Name: "living"}, test.nowPlaying).State; got != test.want {
+			t.Errorf("state for %+v = %v, want %v", test.nowPlaying, got, test.want)
+		}
+	}
+}
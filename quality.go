@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	plex "github.com/jrudio/go-plex-client"
+)
+
+// Quality describes what is actually being played, as opposed to what the
+// library item is best available as.
+type Quality struct {
+	Resolution    string `json:"resolution,omitempty"`
+	VideoCodec    string `json:"video_codec,omitempty"`
+	DynamicRange  string `json:"dynamic_range,omitempty"`
+	AudioCodec    string `json:"audio_codec,omitempty"`
+	AudioChannels string `json:"audio_channels,omitempty"`
+	Atmos         bool   `json:"atmos,omitempty"`
+	Decision      string `json:"decision,omitempty"`
+}
+
+// Badge kinds a room can select with its "quality" setting.
+const (
+	badgeResolution   = "resolution"
+	badgeVideoCodec   = "video_codec"
+	badgeDynamicRange = "dynamic_range"
+	badgeAudio        = "audio"
+	badgeDecision     = "decision"
+)
+
+// validateQuality reports an error for a badge kind that doesn't exist, or
+// an icon keyed by one. Icons are keyed by the badge as shown, like "4k",
+// which can't be checked ahead of time.
+func validateQuality(kinds []string, icons map[string]string) error {
+	known := map[string]bool{}
+	for _, kind := range []string{badgeResolution, badgeVideoCodec, badgeDynamicRange, badgeAudio, badgeDecision} {
+		known[kind] = true
+	}
+
+	for _, kind := range kinds {
+		if !known[kind] {
+			return fmt.Errorf("unknown quality badge %v", kind)
+		}
+	}
+
+	for badge := range icons {
+		if badge == "" {
+			return errors.New("quality icon for an empty badge")
+		}
+
+		if known[badge] {
+			return fmt.Errorf("quality icon keyed by the badge kind %v rather than a badge, like \"4k\"", badge)
+		}
+	}
+
+	return nil
+}
+
+var videoCodecNames = map[string]string{
+	"h264":       "H264",
+	"hevc":       "HEVC",
+	"h265":       "HEVC",
+	"av1":        "AV1",
+	"vp9":        "VP9",
+	"mpeg2video": "MPEG2",
+	"vc1":        "VC1",
+}
+
+var audioCodecNames = map[string]string{
+	"truehd": "TrueHD",
+	"eac3":   "DD+",
+	"ac3":    "DD",
+	"dca":    "DTS",
+	"dts":    "DTS",
+	"aac":    "AAC",
+	"flac":   "FLAC",
+	"mp3":    "MP3",
+	"opus":   "Opus",
+	"pcm":    "PCM",
+}
+
+// qualityFromMedia builds a Quality from a session's media, preferring the
+// selected streams of the part being played over the media summary.
+func qualityFromMedia(media plex.MediaV1) Quality {
+	quality := Quality{
+		Resolution:    normalizeResolution(media.VideoResolution),
+		VideoCodec:    codecName(videoCodecNames, media.VideoCodec),
+		AudioCodec:    codecName(audioCodecNames, media.AudioCodec),
+		AudioChannels: channelLayout(int(media.AudioChannels)),
+	}
+
+	if len(media.Part) == 0 {
+		return quality
+	}
+
+	quality.Decision = streamDecision(media.Part[0].Decision)
+
+	var audio *plex.StreamV1
+	for i, stream := range media.Part[0].Stream {
+		switch stream.StreamType {
+		case 1:
+			quality.DynamicRange = dynamicRange(stream.DisplayTitle)
+			if stream.Codec != "" {
+				quality.VideoCodec = codecName(videoCodecNames, stream.Codec)
+			}
+		case 2:
+			if audio == nil || stream.Selected == "1" || stream.Selected == "true" {
+				audio = &media.Part[0].Stream[i]
+			}
+		}
+	}
+
+	if audio != nil {
+		if audio.Codec != "" {
+			quality.AudioCodec = codecName(audioCodecNames, audio.Codec)
+		}
+
+		if audio.Codec == "dca" && strings.EqualFold(audio.Profile, "ma") {
+			quality.AudioCodec = "DTS-HD MA"
+		}
+
+		if audio.Channels != 0 {
+			quality.AudioChannels = channelLayout(audio.Channels)
+		}
+
+		quality.Atmos = strings.Contains(strings.ToLower(audio.DisplayTitle), "atmos")
+	}
+
+	return quality
+}
+
+func normalizeResolution(res string) string {
+	if res == "" {
+		return ""
+	}
+
+	if strings.EqualFold(res, "4K") || res == "2160" || strings.EqualFold(res, "2160p") {
+		return "4k"
+	}
+
+	if !strings.EqualFold(res[len(res)-1:], "p") {
+		return res + "p"
+	}
+
+	return res
+}
+
+func dynamicRange(displayTitle string) string {
+	title := strings.ToLower(displayTitle)
+
+	switch {
+	case strings.Contains(title, "dovi") || strings.Contains(title, "dolby vision"):
+		return "DV"
+	case strings.Contains(title, "hdr10+"):
+		return "HDR10+"
+	case strings.Contains(title, "hdr"):
+		return "HDR10"
+	case strings.Contains(title, "hlg"):
+		return "HLG"
+	}
+
+	return ""
+}
+
+func codecName(names map[string]string, codec string) string {
+	if name, ok := names[strings.ToLower(codec)]; ok {
+		return name
+	}
+
+	return strings.ToUpper(codec)
+}
+
+// streamDecision names how the server is delivering a stream, from Plex's or
+// Tautulli's spelling of it.
+func streamDecision(decision string) string {
+	switch strings.Replace(strings.ToLower(decision), " ", "", -1) {
+	case "directplay":
+		return "Direct Play"
+	case "copy", "directstream":
+		return "Direct Stream"
+	case "transcode":
+		return "Transcode"
+	}
+
+	return ""
+}
+
+func channelLayout(channels int) string {
+	switch {
+	case channels <= 0:
+		return ""
+	case channels == 1:
+		return "Mono"
+	case channels == 2:
+		return "Stereo"
+	default:
+		return fmt.Sprintf("%d.1", channels-1)
+	}
+}
+
+// Badges returns short display strings for the requested badge kinds, in the
+// order given, skipping any the stream has nothing to say about.
+func (q Quality) Badges(kinds []string) []string {
+	var badges []string
+
+	for _, kind := range kinds {
+		var badge string
+
+		switch kind {
+		case badgeResolution:
+			badge = q.Resolution
+		case badgeVideoCodec:
+			badge = q.VideoCodec
+		case badgeDynamicRange:
+			badge = q.DynamicRange
+		case badgeAudio:
+			badge = q.audioBadge()
+		case badgeDecision:
+			badge = q.Decision
+		}
+
+		if badge != "" {
+			badges = append(badges, badge)
+		}
+	}
+
+	return badges
+}
+
+// audioBadge is the codec, Atmos if present and the channels, e.g.
+// "TrueHD Atmos 7.1".
+func (q Quality) audioBadge() string {
+	badge := q.AudioCodec
+	if q.Atmos {
+		badge += " Atmos"
+	}
+
+	return strings.TrimSpace(badge + " " + q.AudioChannels)
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestAudioBadge(t *testing.T) {
+	tests := []struct {
+		quality Quality
+		want    string
+	}{
+		{Quality{AudioCodec: "TrueHD", AudioChannels: "7.1", Atmos: true}, "TrueHD Atmos 7.1"},
+		{Quality{AudioCodec: "EAC3", AudioChannels: "5.1", Atmos: true}, "EAC3 Atmos 5.1"},
+		{Quality{AudioCodec: "DTS-HD MA", AudioChannels: "5.1"}, "DTS-HD MA 5.1"},
+		{Quality{AudioChannels: "7.1", Atmos: true}, "Atmos 7.1"},
+		{Quality{AudioCodec: "AAC"}, "AAC"},
+		{Quality{}, ""},
+	}
+
+	for _, test := range tests {
+		if got := test.quality.audioBadge(); got != test.want {
+			t.Errorf("audioBadge(%+v) = %q, want %q", test.quality, got, test.want)
+		}
+	}
+}
+
+func TestValidateQuality(t *testing.T) {
+	tests := []struct {
+		kinds []string
+		icons map[string]string
+		valid bool
+	}{
+		{nil, nil, true},
+		{[]string{"resolution", "video_codec", "dynamic_range", "audio", "decision"}, map[string]string{"4k": "i12345"}, true},
+		{[]string{"resolution", "hdr"}, nil, false},
+		{[]string{"Resolution"}, nil, false},
+		{[]string{"resolution"}, map[string]string{"resolution": "i12345"}, false},
+		{[]string{"resolution"}, map[string]string{"": "i12345"}, false},
+	}
+
+	for _, test := range tests {
+		err := validateQuality(test.kinds, test.icons)
+		if (err == nil) != test.valid {
+			t.Errorf("validateQuality(%v, %v) = %v", test.kinds, test.icons, err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"text/template/parse"
+)
+
+// maxTemplateLength keeps templates passed on the URL to something a clock
+// could reasonably need.
+const maxTemplateLength = 500
+
+// queryOptions applies the options a LaMetric app forwards as query
+// parameters on top of the room's configuration:
+//
+//	room             which room to show, defaulting to the first
+//	template         a frame template, replacing the room's
+//	show_progress    whether to show the "[42%]" progress
+//	show_resolution  whether to add the resolution badge
+//	max_length       the most characters to show in the main frame
+//	max_width        the most pixels to show in the main frame
+//	idle             the text shown when nothing is playing
+//	locale           the language to show text in
+func queryOptions(query url.Values) (Room, DisplayOptions, error) {
+	room, ok := config.findRoom(query.Get("room"))
+	if !ok {
+		return room, DisplayOptions{}, fmt.Errorf("unknown room %v", query.Get("room"))
+	}
+
+	opts := room.displayOptions()
+
+	if template := query.Get("template"); template != "" {
+		if len(template) > maxTemplateLength {
+			return room, opts, fmt.Errorf("template is longer than %d characters", maxTemplateLength)
+		}
+
+		tmpl, err := parseTemplate(template)
+		if err == nil && len(tmpl.Templates()) > 1 {
+			err = errors.New("define and block aren't allowed")
+		}
+		if err == nil {
+			err = checkQueryTemplate(tmpl.Tree.Root)
+		}
+		if err != nil {
+			return room, opts, fmt.Errorf("invalid template: %v", err)
+		}
+
+		room.Template = template
+	}
+
+	if value := query.Get("show_progress"); value != "" {
+		show, err := strconv.ParseBool(value)
+		if err != nil {
+			return room, opts, fmt.Errorf("invalid show_progress %v", value)
+		}
+
+		opts.HideProgress = !show
+	}
+
+	if value := query.Get("show_resolution"); value != "" {
+		show, err := strconv.ParseBool(value)
+		if err != nil {
+			return room, opts, fmt.Errorf("invalid show_resolution %v", value)
+		}
+
+		opts.QualityBadges = withBadge(opts.QualityBadges, badgeResolution, show)
+	}
+
+	if value := query.Get("max_length"); value != "" {
+		length, err := strconv.Atoi(value)
+		if err != nil || length < 0 {
+			return room, opts, fmt.Errorf("invalid max_length %v", value)
+		}
+
+		opts.MaxLength = length
+	}
+
+	if value := query.Get("max_width"); value != "" {
+		width, err := strconv.Atoi(value)
+		if err != nil || width < 0 {
+			return room, opts, fmt.Errorf("invalid max_width %v", value)
+		}
+
+		opts.MaxWidth = width
+	}
+
+	if idle := query.Get("idle"); idle != "" {
+		opts.IdleText = idle
+	}
+
+	if locale := query.Get("locale"); locale != "" {
+		err := validateLocale(locale)
+		if err != nil {
+			return room, opts, err
+		}
+
+		opts.Locale = locale
+	}
+
+	return room, opts, nil
+}
+
+// withBadge adds or removes a badge kind, keeping the order of the others.
+func withBadge(kinds []string, kind string, include bool) []string {
+	var result []string
+	for _, k := range kinds {
+		if k != kind {
+			result = append(result, k)
+		}
+	}
+
+	if include {
+		result = append([]string{kind}, result...)
+	}
+
+	return result
+}
+
+// checkQueryTemplate rejects the loops and template calls that would let a
+// short template on the URL run for as long as it likes. Output is capped by
+// render either way.
+func checkQueryTemplate(node parse.Node) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		for _, child := range n.Nodes {
+			if err := checkQueryTemplate(child); err != nil {
+				return err
+			}
+		}
+	case *parse.RangeNode:
+		return errors.New("range isn't allowed")
+	case *parse.TemplateNode:
+		return errors.New("template isn't allowed")
+	case *parse.IfNode:
+		return checkQueryBranch(n.List, n.ElseList)
+	case *parse.WithNode:
+		return checkQueryBranch(n.List, n.ElseList)
+	}
+
+	return nil
+}
+
+func checkQueryBranch(list, elseList *parse.ListNode) error {
+	if err := checkQueryTemplate(list); err != nil {
+		return err
+	}
+
+	if elseList != nil {
+		return checkQueryTemplate(elseList)
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestQueryTemplateRejectsLoops(t *testing.T) {
+	config = Config{Rooms: []Room{{Name: "living"}}}
+
+	for _, template := range []string{
+		`{{range 20000000}}x{{end}}`,
+		`{{if .Title}}{{range 10}}{{end}}{{end}}`,
+		`{{with .Title}}{{else}}{{template "frame"}}{{end}}`,
+		`{{define "a"}}x{{end}}{{.Title}}`,
+		`{{block "a" .}}x{{end}}`,
+	} {
+		_, _, err := queryOptions(url.Values{"template": {template}})
+		if err == nil {
+			t.Errorf("queryOptions accepted %q", template)
+		}
+	}
+
+	room, _, err := queryOptions(url.Values{"template": {`{{if .Title}}{{.Title}}{{else}}idle{{end}} · {{percent}}%`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if room.Template == "" {
+		t.Error("queryOptions dropped the template")
+	}
+}
+
+func TestTemplateOutputIsCapped(t *testing.T) {
+	room := Room{Name: "living", Template: `{{range 20000000}}a very long title {{end}}`}
+	nowPlaying := NowPlaying{Title: "Dinner Party"}
+
+	start := time.Now()
+	text := room.render(nowPlaying, defaultDisplayOptions, start)
+
+	if time.Since(start) > time.Second {
+		t.Errorf("render took %v", time.Since(start))
+	}
+
+	// Rendering falls back to the default text once the cap is hit.
+	if text != nowPlaying.Format(defaultDisplayOptions) {
+		t.Errorf("render = %q", text)
+	}
+}
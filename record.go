@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	plex "github.com/jrudio/go-plex-client"
+	hass "github.com/kylegrantlucas/go-hass"
+)
+
+// Kinds of recorded upstream traffic.
+const (
+	recordPlexNotification = "plex_notification"
+	recordPlexSessions     = "plex_sessions"
+	recordHAState          = "ha_state"
+)
+
+// clock is the time the display pipeline runs at. A replay moves it to the
+// recording's.
+var clock = time.Now
+
+// stateReader reads Home Assistant entity states; a *hass.Access, or a
+// recording or replay of one.
+type stateReader interface {
+	GetState(entity string) (hass.State, error)
+}
+
+var haStates stateReader
+
+// recordedEvent is one line of a recording: something plex-lametric received
+// from upstream, and when.
+type recordedEvent struct {
+	Time   time.Time       `json:"time"`
+	Type   string          `json:"type"`
+	Server string          `json:"server,omitempty"`
+	Entity string          `json:"entity,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// recorder appends events to a JSONL file. A nil recorder records nothing.
+type recorder struct {
+	lock    sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// traffic records upstream traffic when serve runs with -record.
+var traffic *recorder
+
+func newRecorder(path string) (*recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recorder{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (r *recorder) record(event recordedEvent, data interface{}, err error) {
+	if r == nil {
+		return
+	}
+
+	event.Time = time.Now()
+	if err != nil {
+		event.Error = err.Error()
+	} else {
+		body, err := json.Marshal(data)
+		if err != nil {
+			log.Printf("failed to record %v: %v", event.Type, err)
+			return
+		}
+		event.Data = body
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err = r.encoder.Encode(event)
+	if err != nil {
+		log.Printf("failed to record %v: %v", event.Type, err)
+	}
+}
+
+func (r *recorder) close() {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.file.Close()
+}
+
+// recordingStates records every state read through it.
+type recordingStates struct {
+	next stateReader
+}
+
+func (s recordingStates) GetState(entity string) (hass.State, error) {
+	state, err := s.next.GetState(entity)
+	traffic.record(recordedEvent{Type: recordHAState, Entity: entity}, state, err)
+	return state, err
+}
+
+// replayStates answers with the latest recorded state of each entity.
+type replayStates struct {
+	lock   sync.RWMutex
+	states map[string]recordedEvent
+}
+
+func (s *replayStates) GetState(entity string) (hass.State, error) {
+	s.lock.RLock()
+	event, ok := s.states[entity]
+	s.lock.RUnlock()
+
+	var state hass.State
+	if !ok {
+		return state, fmt.Errorf("no recorded state for %v yet", entity)
+	}
+
+	if event.Error != "" {
+		return state, errors.New(event.Error)
+	}
+
+	err := json.Unmarshal(event.Data, &state)
+	return state, err
+}
+
+func (s *replayStates) set(event recordedEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.states[event.Entity] = event
+}
+
+// replayClock runs from the start of a recording at speed times real time,
+// stopping at its end.
+type replayClock struct {
+	lock    sync.Mutex
+	start   time.Time
+	end     time.Time
+	started time.Time
+	speed   float64
+}
+
+func (c *replayClock) now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.start.Add(time.Duration(float64(time.Since(c.started)) * c.speed))
+	if now.After(c.end) {
+		return c.end
+	}
+
+	return now
+}
+
+// runReplay implements `plex-lametric replay`, which serves the app from a
+// recording instead of live servers, feeding its events back through the
+// same session registry and state reads as they happened.
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	port := flags.String("port", config.Port, "port to listen on")
+	speed := flags.Float64("speed", 1, "how many times faster than real time to replay")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: plex-lametric replay [-speed n] recording.jsonl")
+	}
+
+	if *speed <= 0 {
+		return errors.New("speed must be positive")
+	}
+
+	for _, room := range config.Rooms {
+		if room.Source != "" {
+			return fmt.Errorf("room %v reads from source %v, which replay can't replay", room.Name, room.Source)
+		}
+	}
+
+	events, err := readRecording(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if len(events) == 0 {
+		return errors.New("the recording is empty")
+	}
+
+	states := &replayStates{states: map[string]recordedEvent{}}
+	haStates = states
+	sources = map[string]source{}
+
+	plexServers = nil
+	servers := map[string]*plexServer{}
+	for _, event := range events {
+		if event.Server != "" && servers[event.Server] == nil {
+			servers[event.Server] = &plexServer{name: event.Server, sessions: map[string]trackedSession{}}
+			plexServers = append(plexServers, servers[event.Server])
+		}
+	}
+
+	replay := &replayClock{
+		start:   events[0].Time,
+		end:     events[len(events)-1].Time,
+		started: time.Now(),
+		speed:   *speed,
+	}
+	clock = replay.now
+
+	http.HandleFunc("/", requireAuth("/", handler))
+	http.HandleFunc("/preview/", requireAuth("/preview", previewHandler))
+	http.HandleFunc("/debug/state", requireAuth("/debug", debugStateHandler))
+	http.HandleFunc("/events", requireAuth("/events", eventsHandler))
+	http.HandleFunc("/events/ws", requireAuth("/events", eventsSocketHandler))
+
+	go runEvents(config.Rooms, parseInterval(config.EventsInterval, 2*time.Second), nil)
+
+	go func() {
+		err := http.ListenAndServe(fmt.Sprintf(":%v", *port), nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	log.Printf("replaying %d events from %v at %vx", len(events), events[0].Time.Format(time.RFC3339), *speed)
+
+	pending := map[string]plex.NotificationContainer{}
+
+	for _, event := range events {
+		wait := time.Duration(float64(event.Time.Sub(replay.start))/(*speed)) - time.Since(replay.started)
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+
+		switch event.Type {
+		case recordHAState:
+			states.set(event)
+		case recordPlexNotification:
+			var n plex.NotificationContainer
+			err := json.Unmarshal(event.Data, &n)
+			if err != nil {
+				log.Printf("skipping notification at %v: %v", event.Time, err)
+				continue
+			}
+			pending[event.Server] = n
+		case recordPlexSessions:
+			event := event
+			servers[event.Server].onPlaying(func() (plex.CurrentSessions, error) {
+				var sessions plex.CurrentSessions
+				if event.Error != "" {
+					return sessions, errors.New(event.Error)
+				}
+
+				err := json.Unmarshal(event.Data, &sessions)
+				return sessions, err
+			}, pending[event.Server])
+		}
+	}
+
+	log.Printf("replay finished at %v, still serving its last state", replay.end.Format(time.RFC3339))
+	select {}
+}
+
+func readRecording(path string) ([]recordedEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []recordedEvent
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		var event recordedEvent
+		err := json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", path, line, err)
+		}
+
+		events = append(events, event)
+	}
+
+	return events, scanner.Err()
+}
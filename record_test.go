@@ -0,0 +1,15 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReplayRefusesSourceRooms(t *testing.T) {
+	config = Config{Rooms: []Room{{Name: "living"}, {Name: "bedroom", Source: "jellyfin"}}}
+
+	err := runReplay([]string{"recording.jsonl"})
+	if err == nil || !strings.Contains(err.Error(), "room bedroom reads from source jellyfin") {
+		t.Errorf("runReplay = %v", err)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	plex "github.com/jrudio/go-plex-client"
+	hass "github.com/kylegrantlucas/go-hass"
+)
+
+// scenarioTimeout bounds how long a step waits for the session registry to
+// catch up with the fake Plex server.
+const scenarioTimeout = 5 * time.Second
+
+// scenario is a scripted run against fake Plex and Home Assistant servers.
+// Each step replaces what the servers report, then asks for the room's
+// frames and compares them to Expect.
+//
+// Room defaults to an Apple TV at media_player.apple_tv and Plex at
+// media_player.plex.
+type scenario struct {
+	Name  string          `json:"name"`
+	Room  json.RawMessage `json:"room,omitempty"`
+	Steps []scenarioStep  `json:"steps"`
+}
+
+// scenarioStep is one moment in a scenario. PlexSessions are the Metadata of
+// a /status/sessions response, announced in order so the last is the most
+// recent; HAStates are Home Assistant states naming their entity_id. Query is
+// added to the request, as the app's options.
+type scenarioStep struct {
+	Name         string            `json:"name"`
+	PlexSessions []json.RawMessage `json:"plex_sessions"`
+	HAStates     []json.RawMessage `json:"ha_states"`
+	Query        string            `json:"query,omitempty"`
+	Expect       json.RawMessage   `json:"expect"`
+}
+
+var scenarioRoom = Room{
+	Name:          "scenario",
+	AppleTVEntity: "media_player.apple_tv",
+	PlexEntity:    "media_player.plex",
+}
+
+var update = flag.Bool("update", false, "rewrite the scenarios' expected frames and the golden files with what is rendered")
+
+// TestScenarios runs every scenario in scenarios/. With -update it rewrites
+// each step's Expect with what was rendered instead.
+func TestScenarios(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("scenarios", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+
+	for _, file := range files {
+		file := file
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".json"), func(t *testing.T) {
+			var s scenario
+			err := readJSON(file, &s)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			results, err := s.run()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, got := range results {
+				step := s.Steps[i]
+
+				if *update {
+					s.Steps[i].Expect = got
+					continue
+				}
+
+				t.Run(step.Name, func(t *testing.T) {
+					if !sameJSON(step.Expect, got) {
+						t.Errorf("\nwant %s\ngot  %s", compactJSON(step.Expect), compactJSON(got))
+					}
+				})
+			}
+
+			if *update {
+				body, err := json.MarshalIndent(s, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = ioutil.WriteFile(file, append(body, '\n'), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestFakeHAEventStream checks the fake announces state changes the way Home
+// Assistant's /api/stream does.
+func TestFakeHAEventStream(t *testing.T) {
+	fakeHA := newFakeHA()
+	defer fakeHA.close()
+
+	response, err := http.Get(fakeHA.server.URL + "/api/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	lines := bufio.NewScanner(response.Body)
+	next := func() string {
+		for lines.Scan() {
+			if line := lines.Text(); line != "" {
+				return strings.TrimPrefix(line, "data: ")
+			}
+		}
+		t.Fatal("stream ended")
+		return ""
+	}
+
+	if ping := next(); ping != `"ping"` {
+		t.Fatalf("first event = %v", ping)
+	}
+
+	playing := json.RawMessage(`{"entity_id": "media_player.plex", "state": "playing"}`)
+	paused := json.RawMessage(`{"entity_id": "media_player.plex", "state": "paused"}`)
+
+	steps := []struct {
+		states []json.RawMessage
+		want   string
+	}{
+		{[]json.RawMessage{playing}, `{"data": {"entity_id": "media_player.plex", "old_state": null, "new_state": {"entity_id": "media_player.plex", "state": "playing"}}, "event_type": "state_changed"}`},
+		{[]json.RawMessage{paused}, `{"data": {"entity_id": "media_player.plex", "old_state": {"entity_id": "media_player.plex", "state": "playing"}, "new_state": {"entity_id": "media_player.plex", "state": "paused"}}, "event_type": "state_changed"}`},
+		{nil, `{"data": {"entity_id": "media_player.plex", "old_state": {"entity_id": "media_player.plex", "state": "paused"}, "new_state": null}, "event_type": "state_changed"}`},
+	}
+
+	for _, step := range steps {
+		err := fakeHA.setStates(step.states)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := next(); !sameJSON(json.RawMessage(got), json.RawMessage(step.want)) {
+			t.Errorf("\nwant %s\ngot  %s", compactJSON(json.RawMessage(step.want)), got)
+		}
+	}
+}
+
+// run plays the scenario against fresh fake servers, returning the response
+// body for each step.
+func (s scenario) run() ([]json.RawMessage, error) {
+	fakePlex := newFakePlex()
+	defer fakePlex.close()
+
+	fakeHA := newFakeHA()
+	defer fakeHA.close()
+
+	room := scenarioRoom
+	if s.Room != nil {
+		room = Room{}
+		err := json.Unmarshal(s.Room, &room)
+		if err != nil {
+			return nil, fmt.Errorf("room: %v", err)
+		}
+	}
+
+	config = Config{
+		HAHost: fakeHA.server.URL,
+		Rooms:  []Room{room},
+	}
+	haClient = hass.NewAccess(config.HAHost, "")
+	haStates = haClient
+	sources = map[string]source{}
+	posterIcons = iconCache{icons: map[string]string{}}
+
+	client, err := plex.New(fakePlex.server.URL, "scenario")
+	if err != nil {
+		return nil, err
+	}
+
+	server := &plexServer{name: "plex", token: "scenario", sessions: map[string]trackedSession{}}
+	plexServers = []*plexServer{server}
+	server.subscribe(client)
+	defer server.close(time.Second)
+
+	err = waitFor(func() bool { return fakePlex.subscribers() > 0 })
+	if err != nil {
+		return nil, errors.New("plex websocket never connected")
+	}
+
+	var results []json.RawMessage
+	var previous []string
+
+	for _, step := range s.Steps {
+		err := fakeHA.setStates(step.HAStates)
+		if err != nil {
+			return nil, fmt.Errorf("step %v: %v", step.Name, err)
+		}
+
+		var sessions []plex.MetadataV1
+		var keys []string
+		for _, raw := range step.PlexSessions {
+			var session plex.MetadataV1
+			err := json.Unmarshal(raw, &session)
+			if err != nil {
+				return nil, fmt.Errorf("step %v: %v", step.Name, err)
+			}
+
+			sessions = append(sessions, session)
+			keys = append(keys, session.SessionKey)
+		}
+
+		fakePlex.setSessions(step.PlexSessions)
+
+		// A notification about a session that ended still refreshes the
+		// registry.
+		start := time.Now()
+		if len(keys) > 0 {
+			fakePlex.notify(keys)
+		} else {
+			fakePlex.notify(previous)
+		}
+		previous = keys
+
+		err = waitFor(func() bool { return registryMatches(server, sessions, start) })
+		if err != nil {
+			return nil, fmt.Errorf("step %v: plex sessions never arrived", step.Name)
+		}
+
+		body, err := renderStep(step)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, body)
+	}
+
+	return results, nil
+}
+
+// registryMatches reports whether the server's registry holds sessions, with
+// the last of them marked as updated since start.
+func registryMatches(server *plexServer, sessions []plex.MetadataV1, start time.Time) bool {
+	tracked := map[string]trackedSession{}
+	for _, session := range server.Sessions() {
+		tracked[session.Session.SessionKey] = session
+	}
+
+	if len(tracked) != len(sessions) {
+		return false
+	}
+
+	for _, session := range sessions {
+		got, ok := tracked[session.SessionKey]
+		if !ok || got.Session.ViewOffset != session.ViewOffset || got.Session.Title != session.Title || got.Session.Player.State != session.Player.State {
+			return false
+		}
+	}
+
+	if len(sessions) == 0 {
+		return true
+	}
+
+	return tracked[sessions[len(sessions)-1].SessionKey].UpdatedAt.After(start)
+}
+
+// renderStep asks the app for the room's frames the way the clock does. A
+// panic is returned as an error, so -update can't record it as expected.
+func renderStep(step scenarioStep) (body json.RawMessage, err error) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/?"+step.Query, nil)
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("step %v: handler panicked: %v", step.Name, p)
+		}
+	}()
+
+	handler(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		var response interface{} = recorder.Body.String()
+		if json.Valid(recorder.Body.Bytes()) {
+			response = json.RawMessage(recorder.Body.Bytes())
+		}
+
+		body, _ = json.Marshal(map[string]interface{}{"status": recorder.Code, "body": response})
+		return body, nil
+	}
+
+	return recorder.Body.Bytes(), nil
+}
+
+func waitFor(condition func() bool) error {
+	deadline := time.Now().Add(scenarioTimeout)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			return errors.New("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nil
+}
+
+func sameJSON(a, b json.RawMessage) bool {
+	return compactJSON(a) == compactJSON(b)
+}
+
+// compactJSON normalises JSON so equal documents compare equal.
+func compactJSON(raw json.RawMessage) string {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return string(raw)
+	}
+
+	body, _ := json.Marshal(v)
+	return string(body)
+}
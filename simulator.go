@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// The clock's screen, in pixels. Text starts after the icon and a blank
+// column, and sits one row down, leaving the bottom row for goal bars.
+const (
+	screenWidth  = 37
+	screenHeight = 8
+	textLeft     = iconSize + 1
+	textTop      = 1
+)
+
+// Animation timings, in hundredths of a second as GIF wants them.
+const (
+	holdDelay   = 200
+	scrollDelay = 5
+)
+
+// ledScale is how many image pixels wide an LED is in PNG and GIF previews,
+// including the dark gap around it.
+const ledScale = 8
+
+var (
+	ledOff      = color.RGBA{0x33, 0x33, 0x33, 0xff}
+	ledText     = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	ledIcon     = color.RGBA{0x66, 0x66, 0x66, 0xff}
+	ledGoal     = color.RGBA{0x00, 0xcc, 0x00, 0xff}
+	ledGoalBack = color.RGBA{0x66, 0x66, 0x66, 0xff}
+)
+
+// screen is one still of the clock and how long it stays up.
+type screen struct {
+	pixels *image.RGBA
+	delay  int
+}
+
+// simulate plays frames the way the clock does: text that fits is centred
+// and held, longer text is held at the start, scrolled a pixel at a time and
+// held again at the end.
+func simulate(frames []LametricFrame) []screen {
+	var screens []screen
+
+	for _, frame := range frames {
+		area := screenWidth - textLeft
+		width := textWidth(frameText(frame)) - glyphSpacing
+
+		if width <= area {
+			screens = append(screens, screen{drawScreen(frame, textLeft+(area-width)/2), holdDelay})
+			continue
+		}
+
+		screens = append(screens, screen{drawScreen(frame, textLeft), holdDelay / 2})
+		for x := textLeft - 1; x > screenWidth-width; x-- {
+			screens = append(screens, screen{drawScreen(frame, x), scrollDelay})
+		}
+		screens = append(screens, screen{drawScreen(frame, screenWidth-width), holdDelay / 2})
+	}
+
+	return screens
+}
+
+// frameText is what the clock writes on a frame. Goal frames show their
+// current value and unit in place of text.
+func frameText(frame LametricFrame) string {
+	if frame.GoalData != nil {
+		return fmt.Sprintf("%d%s", frame.GoalData.Current, frame.GoalData.Unit)
+	}
+
+	return frame.Text
+}
+
+// drawScreen lights the pixels for a frame with its text starting at x.
+func drawScreen(frame LametricFrame, x int) *image.RGBA {
+	pixels := image.NewRGBA(image.Rect(0, 0, screenWidth, screenHeight))
+
+	drawText(pixels, frameText(frame), x, textTop)
+
+	// The icon covers any text scrolling under it.
+	draw.Draw(pixels, image.Rect(0, 0, textLeft, screenHeight), image.Transparent, image.Point{}, draw.Src)
+	drawIcon(pixels, frame.Icon)
+
+	if frame.GoalData != nil {
+		drawGoal(pixels, *frame.GoalData)
+	}
+
+	return pixels
+}
+
+func drawText(pixels *image.RGBA, text string, x, y int) {
+	for _, r := range text {
+		glyph, ok := font[r]
+		if !ok {
+			glyph = font['?']
+		}
+
+		for row, bits := range glyph {
+			for col, bit := range bits {
+				if bit == '#' {
+					pixels.Set(x+col, y+row, ledText)
+				}
+			}
+		}
+
+		x += len(glyph[0]) + glyphSpacing
+	}
+}
+
+// drawIcon draws an inline icon as it is. Icons referenced by ID live on
+// LaMetric's servers, so they're drawn as a grey outline.
+func drawIcon(pixels *image.RGBA, icon string) {
+	if img := decodeIcon(icon); img != nil {
+		draw.Draw(pixels, image.Rect(0, 0, iconSize, iconSize), img, img.Bounds().Min, draw.Src)
+		return
+	}
+
+	for i := 0; i < iconSize; i++ {
+		pixels.Set(i, 0, ledIcon)
+		pixels.Set(i, iconSize-1, ledIcon)
+		pixels.Set(0, i, ledIcon)
+		pixels.Set(iconSize-1, i, ledIcon)
+	}
+}
+
+func decodeIcon(icon string) image.Image {
+	const prefix = "data:image/png;base64,"
+	if !strings.HasPrefix(icon, prefix) {
+		return nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(icon, prefix))
+	if err != nil {
+		return nil
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+
+	return img
+}
+
+// drawGoal draws the progress bar along the bottom row of the text area.
+func drawGoal(pixels *image.RGBA, goal LametricGoal) {
+	area := screenWidth - textLeft
+	filled := 0
+	if goal.End > goal.Start {
+		filled = area * (goal.Current - goal.Start) / (goal.End - goal.Start)
+	}
+
+	for x := 0; x < area; x++ {
+		c := ledGoalBack
+		if x < filled {
+			c = ledGoal
+		}
+		pixels.Set(textLeft+x, screenHeight-1, c)
+	}
+}
+
+// enlarge draws a screen the way it looks on the clock, each pixel a square
+// LED with a gap around it and unlit ones dimly visible.
+func enlarge(pixels *image.RGBA, dst draw.Image, origin image.Point) {
+	for y := 0; y < screenHeight; y++ {
+		for x := 0; x < screenWidth; x++ {
+			c := color.Color(pixels.RGBAAt(x, y))
+			if _, _, _, a := c.RGBA(); a == 0 {
+				c = ledOff
+			}
+
+			led := image.Rect(x*ledScale+1, y*ledScale+1, (x+1)*ledScale-1, (y+1)*ledScale-1).Add(origin)
+			draw.Draw(dst, led, image.NewUniform(c), image.Point{}, draw.Src)
+		}
+	}
+}
+
+// writeGIF animates the frames.
+func writeGIF(w io.Writer, frames []LametricFrame) error {
+	var anim gif.GIF
+	bounds := image.Rect(0, 0, screenWidth*ledScale, screenHeight*ledScale)
+
+	for _, s := range simulate(frames) {
+		img := image.NewPaletted(bounds, palette.WebSafe)
+		enlarge(s.pixels, img, image.Point{})
+
+		anim.Image = append(anim.Image, img)
+		anim.Delay = append(anim.Delay, s.delay)
+	}
+
+	return gif.EncodeAll(w, &anim)
+}
+
+// writePNG stacks the first screen of every frame.
+func writePNG(w io.Writer, frames []LametricFrame) error {
+	height := screenHeight * ledScale
+	img := image.NewRGBA(image.Rect(0, 0, screenWidth*ledScale, len(frames)*(height+ledScale)))
+	draw.Draw(img, img.Bounds(), image.Black, image.Point{}, draw.Src)
+
+	for i, frame := range frames {
+		enlarge(simulate([]LametricFrame{frame})[0].pixels, img, image.Pt(0, i*(height+ledScale)))
+	}
+
+	return png.Encode(w, img)
+}
+
+// writeTerminal prints the first screen of every frame with half blocks,
+// two rows of LEDs to a line, in 24-bit colour.
+func writeTerminal(w io.Writer, frames []LametricFrame) error {
+	var b strings.Builder
+
+	for _, frame := range frames {
+		pixels := simulate([]LametricFrame{frame})[0].pixels
+
+		for y := 0; y < screenHeight; y += 2 {
+			for x := 0; x < screenWidth; x++ {
+				top, bottom := terminalColor(pixels, x, y), terminalColor(pixels, x, y+1)
+				fmt.Fprintf(&b, "\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm▀", top.R, top.G, top.B, bottom.R, bottom.G, bottom.B)
+			}
+			b.WriteString("\x1b[0m\n")
+		}
+		b.WriteString("\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func terminalColor(pixels *image.RGBA, x, y int) color.RGBA {
+	c := pixels.RGBAAt(x, y)
+	if c.A == 0 {
+		return ledOff
+	}
+
+	return c
+}
+
+// previewHandler serves /preview/{room}.gif and /preview/{room}.png, taking
+// the same options as the app.
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/preview/")
+	ext := path.Ext(name)
+
+	var write func(io.Writer, []LametricFrame) error
+	var contentType string
+
+	switch ext {
+	case ".gif":
+		write, contentType = writeGIF, "image/gif"
+	case ".png":
+		write, contentType = writePNG, "image/png"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	query.Set("room", strings.TrimSuffix(name, ext))
+
+	room, opts, err := queryOptions(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	nowPlaying, err := room.NowPlaying()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	var body bytes.Buffer
+	err = write(&body, room.Frames(nowPlaying, opts))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body.Bytes())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// previewFrames cover a centred frame with an icon by ID, a frame too long to
+// fit with an inline icon, a character the font doesn't have and a goal.
+func previewFrames(t *testing.T) []LametricFrame {
+	icon := image.NewRGBA(image.Rect(0, 0, iconSize, iconSize))
+	for i := 0; i < iconSize; i++ {
+		icon.Set(i, i, color.RGBA{0xe5, 0xa0, 0x0d, 0xff})
+		icon.Set(iconSize-1-i, i, color.RGBA{0xe5, 0xa0, 0x0d, 0xff})
+	}
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, icon)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []LametricFrame{
+		{Text: "S4E13", Icon: defaultIcon},
+		{Text: "The Office - Dinner Party", Icon: "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), Index: 1},
+		{Text: "4K ™", Icon: defaultIcon, Index: 2},
+		{Icon: defaultIcon, GoalData: &LametricGoal{Start: 0, Current: 42, End: 100, Unit: "%"}, Index: 3},
+	}
+}
+
+func TestPreviewGolden(t *testing.T) {
+	tests := []struct {
+		file  string
+		write func(io.Writer, []LametricFrame) error
+	}{
+		{"preview.png", writePNG},
+		{"preview.txt", writeTerminal},
+	}
+
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			var got bytes.Buffer
+			err := test.write(&got, previewFrames(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", test.file)
+			if *update {
+				err := ioutil.WriteFile(golden, got.Bytes(), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("%v differs from the golden file, rerun with -update and check the diff", test.file)
+			}
+		})
+	}
+}
+
+func TestProgressFrame(t *testing.T) {
+	nowPlaying := NowPlaying{Title: "Dinner Party", Progress: 0.42, Duration: 22 * time.Minute}
+
+	frames := Room{Name: "living", ProgressFrame: true}.Frames(nowPlaying, defaultDisplayOptions)
+	if len(frames) != 2 || frames[1].GoalData == nil {
+		t.Fatalf("frames = %+v", frames)
+	}
+
+	want := LametricGoal{Start: 0, Current: 42, End: 100, Unit: "%"}
+	if *frames[1].GoalData != want || frames[1].Index != 1 {
+		t.Errorf("goal frame = %+v, goal %+v", frames[1], *frames[1].GoalData)
+	}
+
+	// Idle rooms and live streams have no progress to show.
+	for _, nowPlaying := range []NowPlaying{{}, {Title: "The News", Channel: "BBC One", Live: true}} {
+		frames := Room{Name: "living", ProgressFrame: true}.Frames(nowPlaying, defaultDisplayOptions)
+		if len(frames) != 1 {
+			t.Errorf("frames for %+v = %+v", nowPlaying, frames)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// source is a media server a room can read what's playing from directly,
+// instead of through Home Assistant.
+type source interface {
+	// NowPlaying is what player is playing, matched by name, or the most
+	// recently active session when player is empty.
+	NowPlaying(player string) (NowPlaying, error)
+
+	// Check reports why the source isn't ready, if it isn't.
+	Check() error
+
+	start()
+	close(timeout time.Duration)
+}
+
+// SourceConfig is one media server rooms can name as their source. Type is
+// jellyfin, emby, tautulli or kodi; Token is the API key.
+//
+// Tautulli sources poll every Interval, and show posters from PlexServer, the
+// name of a configured Plex server, when set.
+type SourceConfig struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	URL        string `json:"url"`
+	Token      string `json:"token"`
+	Interval   string `json:"interval"`
+	PlexServer string `json:"plex_server"`
+}
+
+var sourceTypes = map[string]func(SourceConfig) source{
+	"jellyfin": newJellyfinSource,
+	"emby":     newJellyfinSource,
+	"tautulli": newTautulliSource,
+	"kodi":     newKodiSource,
+}
+
+// sources are the configured sources by name.
+var sources = map[string]source{}
+
+func validateSources(configs []SourceConfig, rooms []Room) error {
+	names := map[string]bool{}
+
+	for _, cfg := range configs {
+		if cfg.Name == "" {
+			return fmt.Errorf("source without a name")
+		}
+
+		if names[cfg.Name] {
+			return fmt.Errorf("source %v is configured twice", cfg.Name)
+		}
+		names[cfg.Name] = true
+
+		if _, ok := sourceTypes[strings.ToLower(cfg.Type)]; !ok {
+			return fmt.Errorf("source %v: unknown type %v", cfg.Name, cfg.Type)
+		}
+
+		if cfg.URL == "" {
+			return fmt.Errorf("source %v: no url", cfg.Name)
+		}
+	}
+
+	for _, room := range rooms {
+		if room.Source != "" && !names[room.Source] {
+			return fmt.Errorf("room %v: unknown source %v", room.Name, room.Source)
+		}
+	}
+
+	return nil
+}
+
+func startSources(configs []SourceConfig) map[string]source {
+	result := map[string]source{}
+
+	for _, cfg := range configs {
+		src := sourceTypes[strings.ToLower(cfg.Type)](cfg)
+		src.start()
+		result[cfg.Name] = src
+	}
+
+	return result
+}
+
+// keepConnected calls connect until stop is closed, waiting retry after each
+// time it returns.
+func keepConnected(name string, retry time.Duration, stop <-chan struct{}, connect func() error) {
+	for {
+		err := connect()
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		log.Printf("source %v disconnected: %v", name, err)
+
+		select {
+		case <-time.After(retry):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// matchesPlayer reports whether any of a session's names is player.
+func matchesPlayer(player string, names ...string) bool {
+	if player == "" {
+		return true
+	}
+
+	for _, name := range names {
+		if strings.EqualFold(name, player) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolutionFromHeight names a video's resolution the way Plex does.
+func resolutionFromHeight(height int) string {
+	switch {
+	case height <= 0:
+		return ""
+	case height > 1088:
+		return "4k"
+	case height > 720:
+		return "1080p"
+	case height > 576:
+		return "720p"
+	case height > 480:
+		return "576p"
+	default:
+		return "480p"
+	}
+}
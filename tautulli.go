@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tautulliSource polls Tautulli's get_activity, which has Plex's sessions
+// with the stream decisions already worked out. A Tautulli webhook pointed at
+// /tautulli/<name> makes it poll straight away.
+type tautulliSource struct {
+	name     string
+	url      string
+	apiKey   string
+	server   string
+	interval time.Duration
+	client   http.Client
+	poke     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+
+	lock      sync.RWMutex
+	sessions  []tautulliSession
+	updatedAt time.Time
+	err       error
+}
+
+// tautulliSession is the part of a get_activity session plex-lametric uses.
+// Tautulli sends most numbers as strings.
+type tautulliSession struct {
+	User                 string      `json:"user"`
+	FriendlyName         string      `json:"friendly_name"`
+	Player               string      `json:"player"`
+	Product              string      `json:"product"`
+	Device               string      `json:"device"`
+	MachineID            string      `json:"machine_id"`
+	SessionKey           tautulliInt `json:"session_key"`
+	State                string      `json:"state"`
+	MediaType            string      `json:"media_type"`
+	Title                string      `json:"title"`
+	GrandparentTitle     string      `json:"grandparent_title"`
+	ParentMediaIndex     tautulliInt `json:"parent_media_index"`
+	MediaIndex           tautulliInt `json:"media_index"`
+	ViewOffset           tautulliInt `json:"view_offset"`
+	Duration             tautulliInt `json:"duration"`
+	Live                 tautulliInt `json:"live"`
+	ChannelTitle         string      `json:"channel_title"`
+	RatingKey            string      `json:"rating_key"`
+	GrandparentRatingKey string      `json:"grandparent_rating_key"`
+	Thumb                string      `json:"thumb"`
+	GrandparentThumb     string      `json:"grandparent_thumb"`
+	TranscodeDecision    string      `json:"transcode_decision"`
+
+	StreamVideoFullResolution string      `json:"stream_video_full_resolution"`
+	StreamVideoCodec          string      `json:"stream_video_codec"`
+	StreamVideoDynamicRange   string      `json:"stream_video_dynamic_range"`
+	StreamAudioCodec          string      `json:"stream_audio_codec"`
+	StreamAudioChannels       tautulliInt `json:"stream_audio_channels"`
+	AudioCodec                string      `json:"audio_codec"`
+	AudioProfile              string      `json:"audio_profile"`
+}
+
+// tautulliInt reads a number Tautulli may send as a string, or empty.
+type tautulliInt int
+
+func (i *tautulliInt) UnmarshalJSON(data []byte) error {
+	text := strings.Trim(string(data), `"`)
+	if text == "" || text == "null" {
+		*i = 0
+		return nil
+	}
+
+	n, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return err
+	}
+
+	*i = tautulliInt(n)
+	return nil
+}
+
+func newTautulliSource(cfg SourceConfig) source {
+	return &tautulliSource{
+		name:     cfg.Name,
+		url:      strings.TrimSuffix(cfg.URL, "/"),
+		apiKey:   cfg.Token,
+		server:   cfg.PlexServer,
+		interval: parseInterval(cfg.Interval, 10*time.Second),
+		client:   http.Client{Timeout: 10 * time.Second},
+		poke:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *tautulliSource) start() {
+	s.poll()
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.poke:
+			case <-s.stop:
+				return
+			}
+
+			s.poll()
+		}
+	}()
+}
+
+func (s *tautulliSource) close(timeout time.Duration) {
+	close(s.stop)
+
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+	}
+}
+
+func (s *tautulliSource) Check() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.err
+}
+
+// refresh asks for a poll as soon as possible.
+func (s *tautulliSource) refresh() {
+	select {
+	case s.poke <- struct{}{}:
+	default:
+	}
+}
+
+func (s *tautulliSource) poll() {
+	sessions, err := s.activity()
+	if err != nil {
+		log.Printf("failed to fetch activity from %v: %v", s.name, err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.err = err
+	if err == nil {
+		s.sessions = sessions
+		s.updatedAt = time.Now()
+	}
+}
+
+func (s *tautulliSource) activity() ([]tautulliSession, error) {
+	query := url.Values{"apikey": {s.apiKey}, "cmd": {"get_activity"}}
+
+	resp, err := s.client.Get(s.url + "/api/v2?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+
+	var body struct {
+		Response struct {
+			Result  string `json:"result"`
+			Message string `json:"message"`
+			Data    struct {
+				Sessions []tautulliSession `json:"sessions"`
+			} `json:"data"`
+		} `json:"response"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body.Response.Result != "success" {
+		return nil, errors.New(body.Response.Message)
+	}
+
+	return body.Response.Data.Sessions, nil
+}
+
+func (s *tautulliSource) NowPlaying(player string) (NowPlaying, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	session := s.session(player)
+	if session == nil {
+		return NowPlaying{}, nil
+	}
+
+	nowPlaying := nowPlayingFromTautulli(*session, s.updatedAt)
+	nowPlaying.Server = s.server
+	return nowPlaying, nil
+}
+
+// session is the player's session, or the most recently active one when
+// several match: playing beats paused or buffering, then the newest session
+// wins, since Plex numbers them in order. The caller holds the lock.
+func (s *tautulliSource) session(player string) *tautulliSession {
+	var current *tautulliSession
+
+	for i, session := range s.sessions {
+		if !matchesPlayer(player, session.Player, session.Device, session.Product, session.MachineID, session.User, session.FriendlyName) {
+			continue
+		}
+
+		if current == nil || moreRecentTautulli(session, *current) {
+			current = &s.sessions[i]
+		}
+	}
+
+	return current
+}
+
+func moreRecentTautulli(a, b tautulliSession) bool {
+	if (a.State == "playing") != (b.State == "playing") {
+		return a.State == "playing"
+	}
+
+	return a.SessionKey > b.SessionKey
+}
+
+// nowPlayingFromTautulli maps a session the same way buildNowPlaying does for
+// Plex, using the quality of the stream as delivered.
+func nowPlayingFromTautulli(session tautulliSession, updatedAt time.Time) NowPlaying {
+	duration := time.Duration(session.Duration) * time.Millisecond
+	position := time.Duration(session.ViewOffset) * time.Millisecond
+
+	nowPlaying := NowPlaying{
+		ShowTitle: session.GrandparentTitle,
+		Title:     session.Title,
+		Progress:  progress(float64(position), float64(duration)),
+		Paused:    session.State == "paused",
+		Live:      session.Live == 1 || duration == 0,
+		Duration:  duration,
+		Position:  position,
+		UpdatedAt: updatedAt,
+	}
+
+	if session.MediaType == "episode" {
+		nowPlaying.Season = int(session.ParentMediaIndex)
+		nowPlaying.Episode = int(session.MediaIndex)
+	}
+
+	if session.Live == 1 {
+		nowPlaying.Channel = session.ChannelTitle
+	}
+
+	nowPlaying.setArtwork(session.RatingKey, session.Thumb, session.GrandparentRatingKey, session.GrandparentThumb)
+
+	quality := Quality{
+		Resolution:    normalizeResolution(session.StreamVideoFullResolution),
+		VideoCodec:    codecName(videoCodecNames, session.StreamVideoCodec),
+		AudioCodec:    codecName(audioCodecNames, session.StreamAudioCodec),
+		AudioChannels: channelLayout(int(session.StreamAudioChannels)),
+		Decision:      streamDecision(session.TranscodeDecision),
+	}
+
+	if session.StreamVideoDynamicRange != "SDR" {
+		quality.DynamicRange = dynamicRange(session.StreamVideoDynamicRange)
+	}
+
+	// Atmos only survives when the audio isn't transcoded.
+	if session.StreamAudioCodec == session.AudioCodec {
+		quality.Atmos = strings.Contains(strings.ToLower(session.AudioProfile), "atmos")
+	}
+
+	if quality.Resolution != "" {
+		nowPlaying.Resolution = &quality.Resolution
+	}
+	if quality != (Quality{}) {
+		nowPlaying.Quality = &quality
+	}
+
+	return nowPlaying
+}
+
+// tautulliWebhookHandler serves /tautulli/<source>, for Tautulli's webhook
+// notification agent. Whatever the notification says, it means the activity
+// changed.
+func tautulliWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	src, ok := sources[strings.TrimPrefix(r.URL.Path, "/tautulli/")].(*tautulliSource)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	src.refresh()
+	w.WriteHeader(http.StatusNoContent)
+}
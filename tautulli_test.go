@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTautulliSessionSelection(t *testing.T) {
+	var sessions []tautulliSession
+	err := json.Unmarshal([]byte(`[
+		{"session_key": "12", "player": "Bedroom TV", "state": "playing", "title": "Dinner Party"},
+		{"session_key": "30", "player": "Living Room", "state": "paused", "title": "Stress Relief"},
+		{"session_key": "21", "player": "Living Room", "state": "playing", "title": "Roygbiv"},
+		{"session_key": "25", "player": "Living Room", "state": "playing", "title": "Threat Level Midnight"}
+	]`), &sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		player string
+		want   string
+	}{
+		{"Bedroom TV", "Dinner Party"},
+		{"Living Room", "Threat Level Midnight"},
+		{"", "Threat Level Midnight"},
+		{"Kitchen", ""},
+	}
+
+	for _, test := range tests {
+		// The answer can't depend on the order Tautulli lists sessions in.
+		for _, order := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {1, 3, 0, 2}} {
+			src := &tautulliSource{}
+			for _, i := range order {
+				src.sessions = append(src.sessions, sessions[i])
+			}
+
+			nowPlaying, err := src.NowPlaying(test.player)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if nowPlaying.Title != test.want {
+				t.Errorf("player %q in order %v = %q, want %q", test.player, order, nowPlaying.Title, test.want)
+			}
+		}
+	}
+}
+
+func TestTautulliEpisodeArtwork(t *testing.T) {
+	var session tautulliSession
+	err := json.Unmarshal([]byte(`{"media_type": "episode", "rating_key": "1002", "thumb": "/library/metadata/1002/thumb/1",
+		"grandparent_rating_key": "1000", "grandparent_thumb": "/library/metadata/1000/thumb/1"}`), &session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nowPlaying := nowPlayingFromTautulli(session, clock())
+	if nowPlaying.RatingKey != "1000" || nowPlaying.Thumb != "/library/metadata/1000/thumb/1" {
+		t.Errorf("episode artwork = %v %v, want the show's", nowPlaying.RatingKey, nowPlaying.Thumb)
+	}
+
+	session.GrandparentRatingKey = ""
+	session.GrandparentThumb = ""
+
+	nowPlaying = nowPlayingFromTautulli(session, clock())
+	if nowPlaying.RatingKey != "1002" || nowPlaying.Thumb != "/library/metadata/1002/thumb/1" {
+		t.Errorf("artwork without a show poster = %v %v, want its own", nowPlaying.RatingKey, nowPlaying.Thumb)
+	}
+}
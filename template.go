@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// maxTemplateOutput caps what a template can write, far more than a clock
+// can show.
+const maxTemplateOutput = 1024
+
+var errTemplateOutput = errors.New("template output is too long")
+
+// limitedBuffer fails writes past its limit, which stops a template's
+// execution there.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		return 0, errTemplateOutput
+	}
+
+	return b.Buffer.Write(p)
+}
+
+// templateData is what a room's frame template is executed against. Text is
+// the default rendering, so templates can decorate rather than replace it.
+type templateData struct {
+	NowPlaying
+	Room string
+	Text string
+}
+
+// templateFuncs are the helpers available to frame templates, bound to the
+// item being rendered:
+//
+//	{{remaining}}  time left, e.g. "42m" or "1h 05m"
+//	{{endsAt}}     wall clock end time, e.g. "21:47"
+//	{{percent}}    progress as a whole percentage
+func templateFuncs(nowPlaying NowPlaying, now time.Time, loc *time.Location, m messages) template.FuncMap {
+	return template.FuncMap{
+		"remaining": func() string {
+			return formatRemaining(nowPlaying.Remaining(now), m)
+		},
+		"endsAt": func() string {
+			return nowPlaying.EndsAt(now, loc).Format(m.Clock)
+		},
+		"percent": func() int {
+			return int(nowPlaying.Progress * 100)
+		},
+	}
+}
+
+func parseTemplate(text string) (*template.Template, error) {
+	return template.New("frame").Funcs(templateFuncs(NowPlaying{}, time.Time{}, time.UTC, catalog(defaultLocale))).Parse(text)
+}
+
+// text renders the main frame text for a room, through the room's template if
+// it has one, then makes it fit the clock.
+func (r Room) text(nowPlaying NowPlaying, opts DisplayOptions, now time.Time) string {
+	nowPlaying = nowPlaying.sanitizeTitles()
+
+	if opts.StripArticles {
+		nowPlaying.ShowTitle = stripArticle(nowPlaying.ShowTitle)
+		nowPlaying.Title = stripArticle(nowPlaying.Title)
+		nowPlaying.Channel = stripArticle(nowPlaying.Channel)
+	}
+
+	text := abbreviate(sanitize(r.render(nowPlaying, opts, now)), roomAbbreviations.get(r.Name, opts.Abbreviations))
+	return fitText(text, opts.MaxLength, opts.MaxWidth)
+}
+
+func (r Room) render(nowPlaying NowPlaying, opts DisplayOptions, now time.Time) string {
+	text := nowPlaying.Format(opts)
+	if r.Template == "" {
+		return text
+	}
+
+	tmpl, err := parseTemplate(r.Template)
+	if err != nil {
+		log.Printf("failed to parse template for room %v: %v", r.Name, err)
+		return text
+	}
+
+	buf := &limitedBuffer{limit: maxTemplateOutput}
+	err = tmpl.Funcs(templateFuncs(nowPlaying, now, r.location(), catalog(opts.Locale))).Execute(buf, templateData{
+		NowPlaying: nowPlaying,
+		Room:       r.Name,
+		Text:       text,
+	})
+	if err != nil {
+		log.Printf("failed to render template for room %v: %v", r.Name, err)
+		return text
+	}
+
+	return strings.TrimSpace(buf.String())
+}
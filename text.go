@@ -0,0 +1,284 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// The clock's font only has ASCII and a few extras, so everything else is
+// transliterated or dropped before it gets there.
+var transliterations = map[rune]string{
+	'‘': "'", '’': "'", '‚': "'", '′': "'",
+	'“': `"`, '”': `"`, '„': `"`, '″': `"`, '«': `"`, '»': `"`,
+	'–': "-", '—': "-", '‐': "-", '‑': "-", '−': "-",
+	'…': "...", '•': "·", '×': "x", '÷': "/",
+	'\u00a0': " ", '\u2009': " ", '\u202f': " ",
+	'ß': "ss", 'Æ': "AE", 'æ': "ae", 'Œ': "OE", 'œ': "oe", 'Þ': "Th", 'þ': "th",
+	'Ø': "O", 'ø': "o", 'Ł': "L", 'ł': "l", 'Đ': "D", 'đ': "d", 'Ð': "D", 'ð': "d",
+	'½': "1/2", '¼': "1/4", '¾': "3/4", '²': "2", '³': "3",
+}
+
+// accents maps each base letter to the accented forms that reduce to it.
+var accents = map[string]string{
+	"A": "ÀÁÂÃÄÅĀĂĄ", "a": "àáâãäåāăą",
+	"C": "ÇĆĈĊČ", "c": "çćĉċč",
+	"D": "Ď", "d": "ď",
+	"E": "ÈÉÊËĒĔĖĘĚ", "e": "èéêëēĕėęě",
+	"G": "ĜĞĠĢ", "g": "ĝğġģ",
+	"H": "ĤĦ", "h": "ĥħ",
+	"I": "ÌÍÎÏĨĪĬĮİ", "i": "ìíîïĩīĭįı",
+	"J": "Ĵ", "j": "ĵ",
+	"K": "Ķ", "k": "ķ",
+	"L": "ĹĻĽĿ", "l": "ĺļľŀ",
+	"N": "ÑŃŅŇ", "n": "ñńņň",
+	"O": "ÒÓÔÕÖŌŎŐ", "o": "òóôõöōŏő",
+	"R": "ŔŖŘ", "r": "ŕŗř",
+	"S": "ŚŜŞŠȘ", "s": "śŝşšș",
+	"T": "ŢŤŦȚ", "t": "ţťŧț",
+	"U": "ÙÚÛÜŨŪŬŮŰŲ", "u": "ùúûüũūŭůűų",
+	"W": "Ŵ", "w": "ŵ",
+	"Y": "ÝŶŸ", "y": "ýÿŷ",
+	"Z": "ŹŻŽ", "z": "źżž",
+}
+
+var cyrillic = map[rune]string{
+	'А': "A", 'Б': "B", 'В': "V", 'Г': "G", 'Д': "D", 'Е': "E", 'Ё': "Yo", 'Ж': "Zh",
+	'З': "Z", 'И': "I", 'Й': "Y", 'К': "K", 'Л': "L", 'М': "M", 'Н': "N", 'О': "O",
+	'П': "P", 'Р': "R", 'С': "S", 'Т': "T", 'У': "U", 'Ф': "F", 'Х': "Kh", 'Ц': "Ts",
+	'Ч': "Ch", 'Ш': "Sh", 'Щ': "Shch", 'Ъ': "", 'Ы': "Y", 'Ь': "", 'Э': "E", 'Ю': "Yu",
+	'Я': "Ya",
+}
+
+func init() {
+	for base, accented := range accents {
+		for _, r := range accented {
+			transliterations[r] = base
+		}
+	}
+
+	for upper, latin := range cyrillic {
+		transliterations[upper] = latin
+		transliterations[unicode.ToLower(upper)] = strings.ToLower(latin)
+	}
+}
+
+// sanitize rewrites text into characters the clock can draw, dropping
+// anything it can't transliterate, like emoji.
+func sanitize(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		if _, ok := glyphWidth(r); ok {
+			b.WriteRune(r)
+		} else if ascii, ok := transliterations[r]; ok {
+			b.WriteString(ascii)
+		} else if unicode.IsSpace(r) {
+			b.WriteRune(' ')
+		}
+	}
+
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// sanitizeTitles runs a NowPlaying's titles through sanitize. A title in a
+// script the clock can't draw, like CJK, would leave just the progress, so
+// the show title stands in for it and the episode; with neither, it shows as
+// idle.
+func (n NowPlaying) sanitizeTitles() NowPlaying {
+	title := n.Title
+
+	n.ShowTitle = sanitize(n.ShowTitle)
+	n.Title = sanitize(n.Title)
+	n.Channel = sanitize(n.Channel)
+
+	if n.Title == "" && title != "" {
+		n.Title, n.ShowTitle = n.ShowTitle, ""
+		n.Season, n.Episode = 0, 0
+	}
+
+	return n
+}
+
+// abbreviation is one compiled entry of a room's abbreviations.
+type abbreviation struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// abbreviationCache holds each room's compiled abbreviations, keyed by room
+// name, along with the map they were compiled from.
+type abbreviationCache struct {
+	sync.Mutex
+	sources  map[string]map[string]string
+	compiled map[string][]abbreviation
+}
+
+var roomAbbreviations = abbreviationCache{
+	sources:  map[string]map[string]string{},
+	compiled: map[string][]abbreviation{},
+}
+
+// get returns the room's compiled abbreviations, compiling them again only
+// when they have changed.
+func (c *abbreviationCache) get(room string, abbreviations map[string]string) []abbreviation {
+	c.Lock()
+	defer c.Unlock()
+
+	if compiled, ok := c.compiled[room]; ok && sameAbbreviations(c.sources[room], abbreviations) {
+		return compiled
+	}
+
+	compiled := compileAbbreviations(abbreviations)
+	c.sources[room] = abbreviations
+	c.compiled[room] = compiled
+
+	return compiled
+}
+
+func sameAbbreviations(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for word, replacement := range a {
+		if other, ok := b[word]; !ok || other != replacement {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compileAbbreviations matches each key as a whole word, longest first so
+// "Season" wins over "Sea".
+func compileAbbreviations(abbreviations map[string]string) []abbreviation {
+	var words []string
+	for word := range abbreviations {
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+
+	sort.Slice(words, func(i, j int) bool {
+		if len(words[i]) != len(words[j]) {
+			return len(words[i]) > len(words[j])
+		}
+		return words[i] < words[j]
+	})
+
+	var compiled []abbreviation
+	for _, word := range words {
+		compiled = append(compiled, abbreviation{
+			pattern:     regexp.MustCompile(`\b` + regexp.QuoteMeta(word) + `\b`),
+			replacement: abbreviations[word],
+		})
+	}
+
+	return compiled
+}
+
+// abbreviate replaces each whole-word occurrence of the abbreviations' keys.
+func abbreviate(text string, abbreviations []abbreviation) string {
+	for _, a := range abbreviations {
+		text = a.pattern.ReplaceAllLiteralString(text, a.replacement)
+	}
+
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// stripArticle drops a leading "The " from a title.
+func stripArticle(title string) string {
+	if len(title) > 4 && strings.EqualFold(title[:4], "the ") {
+		return title[4:]
+	}
+
+	return title
+}
+
+// glyphSpacing is the blank column the clock draws after every character.
+const glyphSpacing = 1
+
+// narrowGlyphs are the characters of the clock's font that aren't the usual
+// three pixels wide.
+var narrowGlyphs = map[rune]int{
+	' ': 1, '!': 1, '\'': 1, ',': 1, '.': 1, ':': 1, ';': 1, '|': 1, '·': 1,
+	'(': 2, ')': 2, '[': 2, ']': 2, '`': 2, 'i': 1, 'l': 2, 'j': 2, 'I': 1,
+	'M': 5, 'W': 5, 'm': 5, 'w': 5, 'N': 4, 'Q': 4, '%': 5, '&': 4, '@': 5,
+	'#': 5, '~': 4, '"': 3,
+}
+
+// glyphWidth is how many pixels wide r is, and whether the font has it.
+func glyphWidth(r rune) (int, bool) {
+	if width, ok := narrowGlyphs[r]; ok {
+		return width, true
+	}
+
+	if r >= ' ' && r <= '~' {
+		return 3, true
+	}
+
+	return 0, false
+}
+
+// textWidth is how many pixels the clock needs to draw text.
+func textWidth(text string) int {
+	width := 0
+	for _, r := range text {
+		w, ok := glyphWidth(r)
+		if !ok {
+			w = 3
+		}
+		width += w + glyphSpacing
+	}
+
+	return width
+}
+
+// fitText shortens text to at most maxLength characters and maxWidth pixels,
+// cutting at a word boundary where it can and ending with "...". Zero limits
+// are ignored.
+func fitText(text string, maxLength, maxWidth int) string {
+	fits := func(s string) bool {
+		return (maxLength <= 0 || len([]rune(s)) <= maxLength) &&
+			(maxWidth <= 0 || textWidth(s) <= maxWidth)
+	}
+
+	if fits(text) {
+		return text
+	}
+
+	const ellipsis = "..."
+	runes := []rune(text)
+
+	// Longest prefix that fits with the ellipsis.
+	end := 0
+	for end < len(runes) && fits(string(runes[:end+1])+ellipsis) {
+		end++
+	}
+
+	cut := end
+	for i := end; i > 0; i-- {
+		if runes[i] == ' ' {
+			cut = i
+			break
+		}
+	}
+
+	prefix := strings.TrimRight(string(runes[:cut]), " ·:-,")
+	if prefix == "" {
+		prefix = strings.TrimRight(string(runes[:end]), " ")
+	}
+
+	if !fits(prefix + ellipsis) {
+		// Not even the ellipsis fits; just cut.
+		end = len(runes)
+		for end > 0 && !fits(string(runes[:end])) {
+			end--
+		}
+		return string(runes[:end])
+	}
+
+	return prefix + ellipsis
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTextWithUndrawableTitles(t *testing.T) {
+	resolution := "1080p"
+	now := time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		nowPlaying NowPlaying
+		want       string
+	}{
+		{
+			name:       "drawable",
+			nowPlaying: NowPlaying{ShowTitle: "Shōgun", Title: "Anjin", Season: 1, Episode: 1, Progress: 0.42},
+			want:       "Shogun S01 · E01: Anjin [42%]",
+		},
+		{
+			name:       "untitled episode",
+			nowPlaying: NowPlaying{ShowTitle: "Attack on Titan", Title: "二千年後の君へ", Season: 1, Episode: 1, Progress: 0.42},
+			want:       "Attack on Titan [42%]",
+		},
+		{
+			name:       "untitled movie",
+			nowPlaying: NowPlaying{Title: "千と千尋の神隠し", Progress: 0.42, Resolution: &resolution},
+			want:       "N/A",
+		},
+		{
+			name:       "greek song",
+			nowPlaying: NowPlaying{ShowTitle: "Vangelis", Title: "Σαν ένα όνειρο", Progress: 0.42},
+			want:       "Vangelis [42%]",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := Room{Name: "living"}.text(test.nowPlaying, defaultDisplayOptions, now)
+			if got != test.want {
+				t.Errorf("text = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAbbreviationsCompiledOnce(t *testing.T) {
+	cache := abbreviationCache{sources: map[string]map[string]string{}, compiled: map[string][]abbreviation{}}
+
+	abbreviations := map[string]string{"Season": "S", "Sea": "~"}
+	first := cache.get("living", abbreviations)
+	if got := abbreviate("Season Sea Seaside", first); got != "S ~ Seaside" {
+		t.Errorf("abbreviate = %q", got)
+	}
+
+	if again := cache.get("living", map[string]string{"Season": "S", "Sea": "~"}); &again[0] != &first[0] {
+		t.Error("unchanged abbreviations were compiled again")
+	}
+
+	changed := cache.get("living", map[string]string{"Season": "Sn"})
+	if got := abbreviate("Season Sea", changed); got != "Sn Sea" {
+		t.Errorf("abbreviate after a change = %q", got)
+	}
+}
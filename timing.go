@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Remaining is how much is left to play as of now. Unless playback is paused,
+// it assumes playback carried on since the position was sampled.
+func (n NowPlaying) Remaining(now time.Time) time.Duration {
+	if n.Duration <= 0 {
+		return 0
+	}
+
+	position := n.Position
+	if !n.Paused && !n.UpdatedAt.IsZero() && now.After(n.UpdatedAt) {
+		position += now.Sub(n.UpdatedAt)
+	}
+
+	if position >= n.Duration {
+		return 0
+	}
+
+	return n.Duration - position
+}
+
+// EndsAt is the wall clock time in loc that playback will finish.
+func (n NowPlaying) EndsAt(now time.Time, loc *time.Location) time.Time {
+	return now.Add(n.Remaining(now)).In(loc)
+}
+
+func (n NowPlaying) timeText(now time.Time, loc *time.Location, m messages) string {
+	return fmt.Sprintf(m.TimeLeft, formatRemaining(n.Remaining(now), m), n.EndsAt(now, loc).Format(m.Clock))
+}
+
+// formatRemaining renders a duration as "42m" or "1h 05m", or however the
+// locale writes them.
+func formatRemaining(d time.Duration, m messages) string {
+	minutes := int(d.Round(time.Minute) / time.Minute)
+
+	if minutes >= 60 {
+		return fmt.Sprintf(m.Hours, minutes/60, minutes%60)
+	}
+
+	return fmt.Sprintf(m.Minutes, minutes)
+}
+
+func (r Room) location() *time.Location {
+	timezone := r.Timezone
+	if timezone == "" {
+		timezone = config.Timezone
+	}
+
+	if timezone == "" {
+		return time.Local
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		log.Printf("failed to load timezone %v: %v", timezone, err)
+		return time.Local
+	}
+
+	return loc
+}
+
+func (r Room) timeIcon() string {
+	if r.TimeIcon != "" {
+		return r.TimeIcon
+	}
+
+	return defaultIcon
+}